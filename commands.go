@@ -0,0 +1,581 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync-secrets/pkg/aws"
+	"sync-secrets/pkg/config"
+	"sync-secrets/pkg/derive"
+	"sync-secrets/pkg/events"
+	"sync-secrets/pkg/explain"
+	"sync-secrets/pkg/helper"
+	"sync-secrets/pkg/lint"
+	"sync-secrets/pkg/notify"
+	"sync-secrets/pkg/report"
+	"sync-secrets/pkg/schema"
+	"sync-secrets/pkg/secret"
+	"sync-secrets/pkg/tags"
+	"sync-secrets/pkg/tracing"
+	"sync-secrets/pkg/transform"
+	"sync-secrets/pkg/vault"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	OutputJSON = "json"
+	OutputText = "text"
+
+	SystemDest   = "dest"
+	SystemSource = "source"
+
+	// Redacted replaces secret values in output
+	Redacted = secret.Redacted
+
+	// listenRetryDelay is the delay before receiving events again after receiving failed
+	listenRetryDelay = 10 * time.Second
+
+	usage = `Usage: secret-sync [command] [flags] [arguments]
+
+Commands:
+  sync                Sync secrets from the source to the destination (default)
+  listen              Sync secrets on change events of Secrets Manager, and fully at intervals
+  plan                Show the changes a sync would make to the destination
+  diff                Show the differences between the source and the destination, by key
+  list                List the secrets a system contributes for the environment
+  get <name>          Show a secret, with its values redacted
+  explain <name>      Explain why a secret in the source is synced or not
+  audit               Report naming and tagging problems of the source secrets
+  validate            Validate the configuration and credentials, without reading secrets
+  rollback <sync-id>  Restore the destination to its state before a sync
+  version             Show the version
+
+Flags:
+  -job <name>         Run only the job with name, from CONFIG_FILE
+  -system <system>    System read by list and get: source or dest (default source)
+  -reveal             Show the values of the secret in get
+  -output <format>    Output of explain and audit: text or json (default text)
+`
+)
+
+// Version of secret-sync, set at build time with -ldflags "-X main.Version=<version>".
+var Version = "dev"
+
+// RunCommand runs command with its args, see usage. Commands are given the jobs in CONFIG_FILE, or
+// the one selected with -job.
+func RunCommand(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	jobName := flags.String("job", "", "")
+	system := flags.String("system", SystemSource, "")
+	reveal := flags.Bool("reveal", false, "")
+	output := flags.String("output", OutputText, "")
+	_ = flags.Parse(args)
+	args = flags.Args()
+
+	if *system != SystemSource && *system != SystemDest {
+		log.Fatalf("-system should be one of: %s, %s", SystemSource, SystemDest)
+	}
+	if *output != OutputText && *output != OutputJSON {
+		log.Fatalf("-output should be one of: %s, %s", OutputText, OutputJSON)
+	}
+
+	switch command {
+	case "sync":
+		CommandSync(GetJobs(*jobName))
+
+	case "listen":
+		CommandListen(GetJobs(*jobName))
+
+	case "plan":
+		CommandPlan(GetJobs(*jobName), false)
+
+	case "diff":
+		CommandPlan(GetJobs(*jobName), true)
+
+	case "list":
+		CommandList(GetJobs(*jobName), *system)
+
+	case "get":
+		if len(args) != 1 {
+			log.Fatal("Usage: secret-sync get [-job <name>] [-system <system>] [-reveal] <name>")
+		}
+		CommandGet(GetJob(*jobName), *system, args[0], *reveal)
+
+	case "explain":
+		if len(args) != 1 {
+			log.Fatal("Usage: secret-sync explain [-job <name>] [-output <format>] <name>")
+		}
+		CommandExplain(GetJobs(*jobName), args[0], *output)
+
+	case "audit":
+		CommandAudit(GetJobs(*jobName), *output)
+
+	case "validate":
+		CommandValidate(GetJobs(*jobName))
+
+	case "rollback":
+		// The job can also be given after the sync ID
+		if len(args) == 2 && *jobName == "" {
+			*jobName = args[1]
+		} else if len(args) != 1 {
+			log.Fatal("Usage: secret-sync rollback [-job <name>] <sync-id>")
+		}
+		SetJob(GetJob(*jobName))
+		RollbackDestination(args[0])
+
+	case "version":
+		fmt.Println(Version)
+
+	case "help":
+		fmt.Fprint(os.Stdout, usage)
+
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// CommandAudit prints the findings about the source secrets of each job: secrets without or with
+// unknown or contradicting environments, secrets synced to the same name, and secrets exceeding the
+// tag limits of the destination. Exits with an error if there are error findings.
+func CommandAudit(jobs []*config.Job, output string) {
+	type jobFinding struct {
+		Job string `json:"job"`
+		*lint.Finding
+	}
+	var findings []*jobFinding
+	var errors int
+
+	for _, job := range jobs {
+		SetJob(job)
+
+		var limits *tags.Limits
+		switch helper.Getenv(PrefixDest, EnvSystem) {
+		case SystemAws:
+			limits = &aws.TagLimits
+		case SystemVault:
+			limits = &vault.MetadataLimits
+		}
+
+		jobFindings := lint.Lint(NewSystem(PrefixSource, nil).GetAllSecrets(), limits, LoadTagRules())
+		for _, f := range jobFindings {
+			findings = append(findings, &jobFinding{Job: job.Name, Finding: f})
+		}
+		errors += lint.Errors(jobFindings)
+	}
+
+	if output == OutputJSON {
+		if findings == nil {
+			findings = []*jobFinding{}
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(findings); err != nil {
+			log.WithError(err).Fatal("Failed to write findings")
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "JOB\tSEVERITY\tCHECK\tNAME\tMESSAGE")
+		for _, f := range findings {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", f.Job, f.Severity, f.Check, f.Name, f.Message)
+		}
+		w.Flush()
+	}
+
+	log.WithFields(log.Fields{
+		"errors":   errors,
+		"findings": len(findings),
+	}).Info("Audit finished")
+
+	if errors > 0 {
+		os.Exit(1)
+	}
+}
+
+// CommandExplain prints how the source secrets called name are handled by each job: the
+// environment detected for them, whether they belong to the environment of the job, their name in
+// the destination, whether they match the filters of the job, and other secrets with the same name.
+func CommandExplain(jobs []*config.Job, name, output string) {
+	var explanations []*explain.Explanation
+
+	// Jobs are grouped by source, so that each source is read once
+	sources := make(map[string][]*explain.Target)
+	var order []string
+	for _, job := range jobs {
+		SetEnvironment(job.Environment)
+		env := SyncEnv
+
+		if _, ok := sources[job.Source]; !ok {
+			order = append(order, job.Source)
+		}
+		sources[job.Source] = append(sources[job.Source], &explain.Target{
+			Job:         job.Name,
+			Environment: &env,
+			Filter:      job.Filters,
+		})
+	}
+
+	for _, source := range order {
+		for _, job := range jobs {
+			if job.Source == source {
+				SetJob(job)
+				break
+			}
+		}
+
+		all := NewSystem(PrefixSource, nil).GetAllSecrets()
+		for _, s := range explain.Find(all, name) {
+			explanations = append(explanations, explain.Explain(s, all, sources[source]))
+		}
+	}
+
+	if len(explanations) == 0 {
+		log.Fatalf("Secret %s not found in source", name)
+	}
+
+	if output == OutputJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(explanations); err != nil {
+			log.WithError(err).Fatal("Failed to write explanation")
+		}
+		return
+	}
+
+	for i, e := range explanations {
+		if i > 0 {
+			fmt.Println()
+		}
+		e.WriteText(os.Stdout)
+	}
+}
+
+// CommandGet prints the secret called name in system for the environment of job as JSON. Values are
+// redacted unless reveal is set, and the content hash is left out of the metadata.
+func CommandGet(job *config.Job, system, name string, reveal bool) {
+	var found *secret.Secret
+	for _, s := range readSystem(job, system) {
+		if s.Name == name {
+			found = s
+			break
+		}
+	}
+
+	if found == nil {
+		log.Fatalf("Secret %s not found in %s", name, system)
+	}
+
+	data := found.Data
+	if !reveal {
+		data = make(map[string]interface{}, len(found.Data))
+		for key := range found.Data {
+			data[key] = Redacted
+		}
+	}
+
+	// The content hash is derived from the values, so it's never printed
+	metadata := make(map[string]string, len(found.Meta))
+	for key, val := range found.Meta {
+		if key != secret.MetaContentHash {
+			metadata[key] = val
+		}
+	}
+
+	output := map[string]interface{}{
+		"name":     found.Name,
+		"data":     data,
+		"tags":     found.Tags,
+		"metadata": metadata,
+		"version":  found.Version,
+	}
+	if found.Environment != nil {
+		output["environment"] = found.Environment.Name
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(output); err != nil {
+		log.WithError(err).Fatal("Failed to write secret")
+	}
+}
+
+// CommandList prints the secrets system contributes for the environment of each job.
+func CommandList(jobs []*config.Job, system string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB\tNAME\tENVIRONMENT\tKEYS\tVERSION")
+
+	for _, job := range jobs {
+		secrets := readSystem(job, system)
+		sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+
+		for _, s := range secrets {
+			env := ""
+			if s.Environment != nil {
+				env = s.Environment.Name
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", job.Name, s.Name, env, len(s.Data), s.Version)
+		}
+	}
+
+	w.Flush()
+}
+
+// CommandListen syncs secrets for each job whenever they change in Secrets Manager, as notified by
+// events in the SQS queue in SQS_QUEUE_URL. Only the changed secrets are synced. All secrets are
+// synced at start and then every RECONCILE_INTERVAL, so that any missed events are caught up. Runs
+// until it's stopped. Production secrets blocked are logged, they don't stop listening. Messages are
+// kept in the queue if any secret fails, so that it's retried. With leader election, only the
+// leader listens.
+func CommandListen(jobs []*config.Job) {
+	interval := DefaultReconcileInterval
+	if e := helper.Getenv("", EnvReconcileInterval); e != "" {
+		d, err := time.ParseDuration(e)
+		if err != nil || d <= 0 {
+			log.Fatalf("%s should be a positive duration, such as 15m: %s", EnvReconcileInterval, e)
+		}
+		interval = d
+	}
+
+	LoadWebhooks()
+	log.RegisterExitHandler(NotifyAborted)
+	log.RegisterExitHandler(WriteReport)
+
+	listener := events.New("")
+	AcquireLeadership()
+
+	run := func(sync func(job *config.Job) (int, error)) {
+		report.Reset()
+		ctx, span := tracing.Start(context.Background(), "sync.run")
+		TraceContext = ctx
+
+		var blocked int
+		var failed bool
+		for _, job := range jobs {
+			n, err := sync(job)
+			blocked += n
+			failed = failed || err != nil
+		}
+		if blocked > 0 {
+			log.Errorf("%d production secrets blocked from non-production environments", blocked)
+		}
+		if blocked > 0 || failed {
+			tracing.EndWith(span, tracing.OutcomeError)
+		} else {
+			tracing.EndWith(span, tracing.OutcomeOK)
+		}
+
+		TraceContext = context.Background()
+		WriteMetrics()
+		WriteReport()
+	}
+
+	var reconcile time.Time
+	for {
+		if !time.Now().Before(reconcile) {
+			log.Info("Syncing all secrets")
+			run(RunJob)
+			reconcile = time.Now().Add(interval)
+		}
+
+		received, err := listener.Receive(context.Background(), time.Until(reconcile))
+		if err != nil {
+			log.WithFields(log.Fields{"system": "AWS SQS"}).WithError(err).Error("Unable to receive events")
+			time.Sleep(listenRetryDelay)
+			continue
+		}
+
+		// A secret changed several times is synced once
+		var names []string
+		seen := make(map[string]bool)
+		for _, e := range received {
+			log.WithFields(log.Fields{"event": e.Name, "path": e.Secret}).Info("Secret changed")
+			if !seen[e.Secret] {
+				seen[e.Secret] = true
+				names = append(names, e.Secret)
+			}
+		}
+
+		if len(names) > 0 {
+			run(func(job *config.Job) (int, error) { return RunJobFor(job, names) })
+		}
+
+		// Messages are received again once their visibility timeout expires, so failures are retried
+		if failed := report.Failed(); failed > 0 {
+			log.WithFields(log.Fields{
+				"count":  failed,
+				"system": "AWS SQS",
+			}).Warn("Secrets failed to sync, keeping messages for retry")
+			continue
+		}
+
+		for _, e := range received {
+			if err := listener.Delete(e); err != nil {
+				log.WithFields(log.Fields{"system": "AWS SQS"}).WithError(err).Error("Unable to delete message")
+			}
+		}
+	}
+}
+
+// CommandPlan prints the changes a sync of each job would make to its destination, without writing
+// anything. Changes are planned by the destination as in a sync, in a dry run. With keys, the
+// changed keys of each secret are printed as well.
+func CommandPlan(jobs []*config.Job, keys bool) {
+	DryRun = true
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB\tACTION\tNAME\tDETAILS")
+
+	var total int
+	for _, job := range jobs {
+		secrets, _ := PrepareSecrets(job)
+		UpdateDestinationSecrets(secrets, job.Filters)
+		result := report.EndJob()
+
+		changes := make([]*report.Secret, 0, len(result.Secrets))
+		for _, s := range result.Secrets {
+			if s.Action != report.ActionUnchanged {
+				changes = append(changes, s)
+			}
+		}
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+
+		for _, change := range changes {
+			total++
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", job.Name, change.Action, change.Name, describeChange(change))
+
+			if keys {
+				for _, line := range change.Keys {
+					fmt.Fprintf(w, "\t\t  %s\t\n", line)
+				}
+			}
+		}
+	}
+
+	w.Flush()
+	fmt.Printf("\n%d changes\n", total)
+}
+
+// CommandSync syncs secrets for each job, once elected leader if leader election is configured.
+// Exits with an error if production secrets were blocked or the destination of any job refused the
+// sync.
+func CommandSync(jobs []*config.Job) {
+	LoadWebhooks()
+	log.RegisterExitHandler(NotifyAborted)
+	log.RegisterExitHandler(WriteReport)
+	release := AcquireLeadership()
+
+	ctx, span := tracing.Start(TraceContext, "sync.run")
+	TraceContext = ctx
+
+	var blocked, failed int
+	for _, job := range jobs {
+		n, err := RunJob(job)
+		blocked += n
+		if err != nil {
+			failed++
+		}
+	}
+
+	if blocked > 0 {
+		tracing.EndWith(span, tracing.OutcomeError)
+		log.Fatalf("%d production secrets blocked from non-production environments", blocked)
+	}
+	if failed > 0 {
+		tracing.EndWith(span, tracing.OutcomeError)
+		log.Fatalf("%d jobs failed", failed)
+	}
+
+	tracing.EndWith(span, tracing.OutcomeOK)
+	release()
+	WriteMetrics()
+	WriteReport()
+}
+
+// CommandValidate validates the configuration of each job, the rule files and the credentials of
+// the systems. No secrets are read.
+func CommandValidate(jobs []*config.Job) {
+	if path := helper.Getenv("", derive.EnvRulesFile); path != "" {
+		if _, err := derive.Load(path); err != nil {
+			log.WithError(err).Fatalf("Invalid derive rules in %s", path)
+		}
+	}
+
+	if path := helper.Getenv("", notify.EnvWebhooksFile); path != "" {
+		if _, err := notify.Load(path); err != nil {
+			log.WithError(err).Fatalf("Invalid webhooks in %s", path)
+		}
+	}
+
+	if path := helper.Getenv("", schema.EnvRulesFile); path != "" {
+		if _, err := schema.Load(path); err != nil {
+			log.WithError(err).Fatalf("Invalid schema rules in %s", path)
+		}
+	}
+
+	if path := helper.Getenv("", transform.EnvRulesFile); path != "" {
+		if _, err := transform.Load(path); err != nil {
+			log.WithError(err).Fatalf("Invalid transform rules in %s", path)
+		}
+	}
+
+	for _, job := range jobs {
+		SetJob(job)
+		SetEnvironment(job.Environment)
+
+		if err := NewSystem(PrefixSource, job.Filters).Validate(); err != nil {
+			log.WithError(err).Fatalf("Invalid credentials for source of job %s", job.Name)
+		}
+		if err := NewSystem(PrefixDest, job.Filters).Validate(); err != nil {
+			log.WithError(err).Fatalf("Invalid credentials for destination of job %s", job.Name)
+		}
+
+		fmt.Printf("%s: ok\n", job.Name)
+	}
+}
+
+// describeChange returns a summary of change: its reason or error, and the number of keys added,
+// changed and removed.
+func describeChange(change *report.Secret) string {
+	var details []string
+	for _, d := range []string{change.Reason, change.Error} {
+		if d != "" {
+			details = append(details, d)
+		}
+	}
+
+	counts := make(map[byte]int)
+	for _, line := range change.Keys {
+		counts[line[0]]++
+	}
+	for _, d := range []struct {
+		prefix byte
+		verb   string
+	}{{'+', "added"}, {'~', "changed"}, {'-', "removed"}} {
+		if counts[d.prefix] > 0 {
+			details = append(details, fmt.Sprintf("%d keys %s", counts[d.prefix], d.verb))
+		}
+	}
+
+	return strings.Join(details, ", ")
+}
+
+// readSystem returns the secrets of job in system: from the source, the secrets it contributes for
+// the environment of job, and from the destination, all its current secrets.
+func readSystem(job *config.Job, system string) []*secret.Secret {
+	SetJob(job)
+
+	if system == SystemDest {
+		return NewSystem(PrefixDest, job.Filters).GetCurrentSecrets()
+	}
+
+	SetEnvironment(job.Environment)
+	return NewSystem(PrefixSource, job.Filters).GetSecrets(&SyncEnv)
+}
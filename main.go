@@ -1,58 +1,393 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"sync-secrets/pkg/audit"
 	"sync-secrets/pkg/aws"
+	"sync-secrets/pkg/config"
+	"sync-secrets/pkg/derive"
+	"sync-secrets/pkg/helper"
+	"sync-secrets/pkg/leader"
+	"sync-secrets/pkg/metrics"
+	"sync-secrets/pkg/notify"
+	"sync-secrets/pkg/redact"
+	"sync-secrets/pkg/report"
+	"sync-secrets/pkg/schema"
 	"sync-secrets/pkg/secret"
+	"sync-secrets/pkg/tags"
+	"sync-secrets/pkg/tracing"
+	"sync-secrets/pkg/transform"
 	"sync-secrets/pkg/vault"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
 	PrefixDest   = "DEST_"
 	PrefixSource = "SOURCE_"
 
-	EnvLogLevel = "LOG_LEVEL"
-	EnvSyncEnv  = "ENVIRONMENT"
-	EnvSystem   = "SYSTEM"
+	EnvLogFormat         = "LOG_FORMAT"
+	EnvLogLevel          = "LOG_LEVEL"
+	EnvReconcileInterval = "RECONCILE_INTERVAL"
+	EnvSyncEnv           = "ENVIRONMENT"
+	EnvSystem            = "SYSTEM"
 
-	SystemAws   = "aws"
-	SystemVault = "vault"
+	// DefaultReconcileInterval is the interval of full syncs when listening to change events
+	DefaultReconcileInterval = 15 * time.Minute
+
+	SystemAws   = config.SystemAws
+	SystemVault = config.SystemVault
 )
 
-var SyncEnv secret.Environment
+// A System secrets are synced from.
+type System interface {
+	GetAllSecrets() []*secret.Secret
+	GetCurrentSecrets() []*secret.Secret
+	GetSecrets(env *secret.Environment) []*secret.Secret
+	Identity() string
+	Validate() error
+}
+
+// A Destination System secrets are synced to.
+type Destination interface {
+	System
+	CheckSecrets(newSecrets []*secret.Secret)
+	UpdateSecrets(newSecrets []*secret.Secret) error
+}
+
+var (
+	Config  *config.Config // Config file, nil if not used
+	DryRun  bool           // Nothing is written, neither to the destination nor to the audit log
+	SyncEnv secret.Environment
+	SyncID  string
+
+	Webhooks []*notify.Webhook // Notified of synced jobs, see LoadWebhooks
+
+	// TraceContext has the span of the current run or job, parent of the spans of systems
+	TraceContext = context.Background()
+)
 
 func init() {
+	log.AddHook(redact.Hook{})
+	SetLogFormat()
 	SetLogLevel()
-	SetEnvironment()
 }
 
 func main() {
-	secrets := GetSourceSecrets()
-	UpdateDestinationSecrets(secrets)
+	log.RegisterExitHandler(WriteMetrics)
+	report.SetVersion(Version)
+
+	if err := tracing.Setup(Version); err != nil {
+		log.WithError(err).Fatal("Invalid tracing configuration")
+	}
+	log.RegisterExitHandler(tracing.Shutdown)
+	defer tracing.Shutdown()
+
+	// Without a command, such as with only flags, secrets are synced
+	command, args := "sync", os.Args[1:]
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command, args = os.Args[1], os.Args[2:]
+	}
+
+	RunCommand(command, args)
 }
 
-// SetEnvironment reads the sync environment from environment variable and sets SyncEnv as correct
-// secret.Environment.
-func SetEnvironment() {
-	if v := os.Getenv(EnvSyncEnv); v != "" {
-		if e := secret.GetEnvFromString(v); e != nil {
+// AcquireLeadership waits until this replica is the leader, if leader election is configured in
+// LEADER_ELECTION env variable, so that only one replica syncs at a time. Leadership is kept until
+// the returned func is called, or until exit, and released then. On SIGTERM or SIGINT, the process
+// exits, releasing leadership at once.
+func AcquireLeadership() func() {
+	elector := leader.New()
+	if elector == nil {
+		return func() {}
+	}
+
+	log.RegisterExitHandler(elector.Release)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		s := <-signals
+		log.WithFields(log.Fields{"signal": s.String()}).Info("Stopping")
+		log.Exit(128 + int(s.(syscall.Signal)))
+	}()
+
+	elector.Acquire()
+
+	return elector.Release
+}
+
+// GetJob returns the job called name. Without a config file, or if name is empty and there is only
+// one job, returns the only job.
+func GetJob(name string) *config.Job {
+	jobs := GetJobs("")
+
+	if name == "" {
+		if len(jobs) > 1 {
+			log.Fatalf("More than one job defined in %s, job should be given", os.Getenv(config.EnvFile))
+		}
+		return jobs[0]
+	}
+
+	if Config == nil {
+		log.Fatalf("Job %s given, but %s not defined", name, config.EnvFile)
+	}
+
+	job := Config.Job(name)
+	if job == nil {
+		log.Fatalf("Job %s not defined in %s", name, os.Getenv(config.EnvFile))
+	}
+
+	return job
+}
+
+// GetJobs returns the job called name, or all jobs in the config file if name is empty. Without a
+// config file, returns a single job with the source and destination configured in env variables.
+// The config file is loaded on first use, so that commands without jobs work with any config.
+func GetJobs(name string) []*config.Job {
+	if name != "" {
+		return []*config.Job{GetJob(name)}
+	}
+
+	if Config == nil {
+		LoadConfig()
+	}
+	if Config == nil {
+		return []*config.Job{{Name: "default"}}
+	}
+
+	return Config.Jobs
+}
+
+// LoadConfig reads the config file in CONFIG_FILE env variable, if defined. Its settings are used
+// for env variables which are not defined, and the log format and level are set again with them.
+func LoadConfig() {
+	path := os.Getenv(config.EnvFile)
+	if path == "" {
+		return
+	}
+
+	c, err := config.Load(path)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid config file")
+	}
+
+	helper.SetSettings("", c.Settings)
+	Config = c
+
+	SetLogFormat()
+	SetLogLevel()
+}
+
+// LoadTagRules returns the tag rules in the file in DEST_TAG_RULES_FILE env variable, or nil if not
+// defined. Tag rules are applied by the destination only.
+func LoadTagRules() *tags.Rules {
+	path := helper.Getenv(PrefixDest, tags.EnvRulesFile)
+	if path == "" {
+		return nil
+	}
+
+	rules, err := tags.Load(path)
+	if err != nil {
+		log.WithError(err).Fatalf("Invalid tag rules in %s", path)
+	}
+
+	return rules
+}
+
+// LoadWebhooks reads Webhooks from the file in WEBHOOKS_FILE env variable, if defined.
+func LoadWebhooks() {
+	path := helper.Getenv("", notify.EnvWebhooksFile)
+	if path == "" {
+		return
+	}
+
+	hooks, err := notify.Load(path)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to load webhooks from %s", path)
+	}
+
+	Webhooks = hooks
+}
+
+// NotifyAborted notifies Webhooks of the current job, if any, as aborted.
+func NotifyAborted() {
+	NotifyJob(report.EndJob(), errors.New("sync aborted"))
+}
+
+// NotifyJob notifies Webhooks of the synced job, if not nil. If err is not nil, job was aborted.
+func NotifyJob(job *report.Job, err error) {
+	if job != nil {
+		notify.Notify(Webhooks, job, err)
+	}
+}
+
+// PrepareSecrets returns the secrets of job from the source, transformed, derived, validated and
+// guarded, ready to be written to the destination. Returns also the number of production secrets
+// blocked from the destination.
+func PrepareSecrets(job *config.Job) ([]*secret.Secret, int) {
+	redact.Reset()
+	SetJob(job)
+	SetEnvironment(job.Environment)
+
+	log.WithFields(log.Fields{
+		"environment": SyncEnv.Name,
+		"job":         job.Name,
+		"sync-id":     SyncID,
+	}).Info("Preparing secrets")
+	report.StartJob(job.Name, SyncID, SyncEnv.Name)
+
+	secrets := GetSourceSecrets(job.Filters)
+	TransformSecrets(secrets)
+	DeriveSecrets(secrets)
+	ValidateSecrets(secrets)
+	blocked := GuardProduction(secrets)
+
+	// Transformed and derived values are scrubbed from logs as well as those read
+	for _, s := range secrets {
+		for _, v := range s.Versions() {
+			redact.Register(v.Data)
+		}
+	}
+
+	return secrets, blocked
+}
+
+// RunJob syncs secrets from the source to the destination of job. Returns the number of production
+// secrets blocked from the destination, and an error if the destination refused the sync.
+func RunJob(job *config.Job) (int, error) {
+	parent := TraceContext
+	ctx, span := tracing.Start(parent, "sync.job", attribute.String("job", job.Name))
+	TraceContext = ctx
+	defer func() { TraceContext = parent }()
+
+	secrets, blocked := PrepareSecrets(job)
+	span.SetAttributes(attribute.String("environment", SyncEnv.Name), attribute.String("sync_id", SyncID))
+	err := UpdateDestinationSecrets(secrets, job.Filters)
+	if err != nil {
+		log.WithFields(log.Fields{"job": job.Name}).WithError(err).Error("Sync failed")
+	}
+
+	result := report.EndJob()
+	NotifyJob(result, err)
+
+	if err != nil || blocked > 0 || result.Totals[report.ActionFailed] > 0 {
+		tracing.EndWith(span, tracing.OutcomeError)
+	} else {
+		tracing.EndWith(span, tracing.OutcomeOK)
+	}
+
+	return blocked, err
+}
+
+// RunJobFor syncs only the secrets called any of names from the source to the destination of job,
+// if job syncs them from Secrets Manager. Secrets are selected by narrowing the filters of job, so
+// they are synced just as in a full sync. Returns the number of production secrets blocked, and an
+// error if the destination refused the sync.
+func RunJobFor(job *config.Job, names []string) (int, error) {
+	system := helper.Getenv(PrefixSource, EnvSystem)
+	if Config != nil {
+		system = Config.Sources[job.Source].System
+	}
+	if system != SystemAws {
+		return 0, nil
+	}
+
+	// A name may have the suffix of its environment, which is trimmed when synced to it
+	var candidates []string
+	for _, name := range names {
+		candidates = append(candidates, name)
+
+		trimmed := secret.New(name)
+		trimmed.TrimNameEnv()
+		if trimmed.Name != name {
+			candidates = append(candidates, trimmed.Name)
+		}
+	}
+
+	filters, ok := job.Filters.Narrow(candidates...)
+	if !ok {
+		return 0, nil
+	}
+
+	scoped := *job
+	scoped.Filters = filters
+
+	return RunJob(&scoped)
+}
+
+// SetEnvironment sets SyncEnv as the secret.Environment called env. If env is empty, the sync
+// environment is read from environment variable.
+func SetEnvironment(env string) {
+	if env == "" {
+		env = helper.Getenv("", EnvSyncEnv)
+	}
+
+	if env != "" {
+		if e := secret.GetEnvFromString(env); e != nil {
 			SyncEnv = *e
 		} else {
-			log.Fatalf("%s not accepted value for %s", e, EnvSyncEnv)
+			log.Fatalf("%s not accepted value for %s", env, EnvSyncEnv)
 		}
 	} else {
 		log.Fatalf("Required env variable %s not defined", EnvSyncEnv)
 	}
 }
 
+// SetJob sets the settings of the source and destination of job from the config file, and a new
+// SyncID.
+func SetJob(job *config.Job) {
+	if Config != nil {
+		for prefix, system := range map[string]*config.System{
+			PrefixSource: Config.Sources[job.Source],
+			PrefixDest:   Config.Destinations[job.Destination],
+		} {
+			settings := map[string]string{EnvSystem: system.System}
+			for key, val := range system.Settings {
+				settings[key] = val
+			}
+			helper.SetSettings(prefix, settings)
+		}
+	}
+
+	SyncID = helper.NewID()
+	audit.SyncID = SyncID
+}
+
+// SetLogFormat reads desired logging format from the LOG_FORMAT env variable and sets it. Possible
+// options are text and json. Defaults to text. In json, each entry is a JSON object with its fields
+// and "time", "level" and "message".
+func SetLogFormat() {
+	switch format := helper.Getenv("", EnvLogFormat); format {
+	case "", "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{
+			FieldMap: log.FieldMap{
+				log.FieldKeyLevel: "level",
+				log.FieldKeyMsg:   "message",
+				log.FieldKeyTime:  "time",
+			},
+		})
+	default:
+		log.Fatalf("%s not accepted value for %s", format, EnvLogFormat)
+	}
+}
+
 // SetLogLevel reads desired logging level from the LOG_LEVEL env variable and sets it. Possible
 // options are debug, info, warn, error, fatal, and panic. Defaults to logrus's default.
 func SetLogLevel() {
 	var envLogLevel string
 
-	if v := os.Getenv(EnvLogLevel); v != "" {
+	if v := helper.Getenv("", EnvLogLevel); v != "" {
 		envLogLevel = v
 	}
 
@@ -70,49 +405,200 @@ func SetLogLevel() {
 	}
 }
 
-// GetSourceSecrets returns a Slice of secrets from the source system.
-func GetSourceSecrets() []*secret.Secret {
-	var system string
-	prefix := PrefixSource
+// WriteMetrics writes collected metrics to the file in METRICS_FILE env variable, if defined.
+func WriteMetrics() {
+	if path := helper.Getenv("", metrics.EnvFile); path != "" {
+		if err := metrics.Write(path); err != nil {
+			log.WithError(err).Errorf("Failed to write metrics to %s", path)
+		}
+	}
+}
 
-	if v := os.Getenv(prefix + EnvSystem); v != "" {
-		system = v
-	} else {
-		log.Fatalf("Required env variable %s not defined", prefix+EnvSystem)
+// WriteReport writes the report of the synced secrets to the file in REPORT_FILE env variable, if
+// defined.
+func WriteReport() {
+	if path := helper.Getenv("", report.EnvFile); path != "" {
+		if err := report.Write(path); err != nil {
+			log.WithError(err).Errorf("Failed to write report to %s", path)
+		}
 	}
+}
 
-	switch system {
-	case SystemAws:
-		a := aws.New(prefix)
-		return a.GetSecrets(&SyncEnv)
+// GetSourceSecrets returns a Slice of secrets from the source system matching filter.
+func GetSourceSecrets(filter *secret.Filter) []*secret.Secret {
+	source := NewSystem(PrefixSource, filter)
+	report.SetSource(helper.Getenv(PrefixSource, EnvSystem), source.Identity())
 
-	case SystemVault:
-		v := vault.New(prefix)
-		return v.GetSecrets(&SyncEnv)
+	return source.GetSecrets(&SyncEnv)
+}
 
-	default:
-		log.Fatalf("%s should be one of: %s, %s", prefix+EnvSystem, SystemAws, SystemVault)
-		return nil // Will not execute
+// DeriveSecrets adds the derived keys in the file in DERIVE_RULES_FILE env variable, if defined, to
+// the data of secrets.
+func DeriveSecrets(secrets []*secret.Secret) {
+	path := helper.Getenv("", derive.EnvRulesFile)
+	if path == "" {
+		return
+	}
+
+	rules, err := derive.Load(path)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to load derive rules from %s", path)
+	}
+
+	derive.Apply(rules, secrets)
+}
+
+// GuardProduction fails the secrets classified as production when SyncEnv is not a production
+// environment, so that they are never written to the destination. Each blocked secret is recorded in
+// the audit log. Returns the number of blocked secrets.
+func GuardProduction(secrets []*secret.Secret) int {
+	if SyncEnv.Production {
+		return 0
+	}
+
+	var blocked int
+	for _, s := range secrets {
+		if !s.IsProduction() {
+			continue
+		}
+
+		blocked++
+		err := fmt.Errorf("%w in %s environment", secret.ErrProduction, SyncEnv.Name)
+		reason := err.Error()
+		s.Fail(err)
+
+		if DryRun {
+			continue
+		}
+
+		err = audit.Record(&audit.Event{
+			Event:       audit.EventProductionBlocked,
+			Path:        s.Name,
+			Environment: SyncEnv.Name,
+			Reason:      reason,
+		})
+		if err != nil {
+			log.WithError(err).Errorf("Failed to write audit log to %s", helper.Getenv("", audit.EnvFile))
+		}
+	}
+
+	metrics.Set("secret_sync_blocked_secrets",
+		"Number of production secrets blocked from a non-production environment.", nil, float64(blocked))
+
+	return blocked
+}
+
+// TransformSecrets applies the transform rules in the file in TRANSFORM_RULES_FILE env variable, if
+// defined, to the data of secrets.
+func TransformSecrets(secrets []*secret.Secret) {
+	path := helper.Getenv("", transform.EnvRulesFile)
+	if path == "" {
+		return
+	}
+
+	rules, err := transform.Load(path)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to load transform rules from %s", path)
+	}
+
+	transform.Apply(rules, secrets)
+}
+
+// ValidateSecrets validates secrets with the schema rules in the file in SCHEMA_RULES_FILE env
+// variable, if defined. Invalid secrets are left untouched in the destination.
+func ValidateSecrets(secrets []*secret.Secret) {
+	path := helper.Getenv("", schema.EnvRulesFile)
+	if path == "" {
+		return
+	}
+
+	rules, err := schema.Load(path)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to load schema rules from %s", path)
+	}
+
+	schema.Apply(rules, secrets)
+}
+
+// UpdateDestinationSecrets sets secrets into the destination system. Only secrets matching the paths
+// of filter in the destination are updated or removed, see NewSystem. Returns an error if the
+// destination refused the sync.
+func UpdateDestinationSecrets(secrets []*secret.Secret, filter *secret.Filter) error {
+	dest := NewDestination(filter)
+	report.SetDestination(helper.Getenv(PrefixDest, EnvSystem), dest.Identity())
+
+	return dest.UpdateSecrets(secrets)
+}
+
+// NewDestination returns the destination system, see NewSystem. Exits if the system cannot be
+// written to.
+func NewDestination(filter *secret.Filter) Destination {
+	dest, ok := NewSystem(PrefixDest, filter).(Destination)
+	if !ok {
+		log.Fatalf("%s should be one of: %s, %s", PrefixDest+EnvSystem, SystemAws, SystemVault)
 	}
+
+	return dest
 }
 
-// UpdateDestinationSecrets sets secrets into the destination system.
-func UpdateDestinationSecrets(secrets []*secret.Secret) {
+// RollbackDestination restores secrets in the destination system to their state before the sync
+// with syncID.
+func RollbackDestination(syncID string) {
+	v, ok := NewSystem(PrefixDest, nil).(*vault.Vault)
+	if !ok {
+		log.Fatalf("%s should be one of: %s", PrefixDest+EnvSystem, SystemVault)
+	}
+
+	if err := v.Rollback(syncID); err != nil {
+		log.WithError(err).Fatalf("Failed to roll back sync %s", syncID)
+	}
+}
+
+// NewSystem returns the system configured with prefix, reading only secrets matching filter. The
+// destination matches only the paths of filter, as tags written to it are mapped by tag rules, see
+// LoadTagRules. Exits if tag rules are set for the source. With DryRun, the destination only plans
+// its changes. A Vault destination records its changes under SyncID. Calls to the system are traced
+// under TraceContext.
+func NewSystem(prefix string, filter *secret.Filter) System {
 	var system string
-	prefix := PrefixDest
 
-	if v := os.Getenv(prefix + EnvSystem); v != "" {
+	if prefix == PrefixDest {
+		filter = filter.PathsOnly()
+	} else if os.Getenv(prefix+tags.EnvRulesFile) != "" {
+		log.Fatalf("%s is not supported, tag rules are applied by the destination only",
+			prefix+tags.EnvRulesFile)
+	}
+
+	if v := helper.Getenv(prefix, EnvSystem); v != "" {
 		system = v
 	} else {
 		log.Fatalf("Required env variable %s not defined", prefix+EnvSystem)
 	}
 
 	switch system {
+	case SystemAws:
+		a := aws.New(prefix)
+		a.Context = TraceContext
+		a.DryRun = DryRun
+		a.Filter = filter
+		if prefix == PrefixDest {
+			a.TagRules = LoadTagRules()
+		}
+		return a
+
 	case SystemVault:
 		v := vault.New(prefix)
-		v.UpdateSecrets(secrets)
+		v.Context = TraceContext
+		v.DryRun = DryRun
+		v.Filter = filter
+		v.SyncID = SyncID
+		if prefix == PrefixDest {
+			v.TagRules = LoadTagRules()
+		}
+		return v
 
 	default:
-		log.Fatalf("%s should be one of: %s", prefix+EnvSystem, SystemVault)
+		log.Fatalf("%s should be one of: %s, %s", prefix+EnvSystem, SystemAws, SystemVault)
+		return nil // Will not execute
 	}
 }
@@ -0,0 +1,156 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"sync-secrets/pkg/helper"
+	"time"
+)
+
+const (
+	EnvChain = "AUDIT_LOG_CHAIN"
+	EnvFile  = "AUDIT_LOG_FILE"
+
+	// Stdout as the audit log file writes events to standard output
+	Stdout = "-"
+
+	EventDataWritten       = "data-written"       // New version of secret data written
+	EventMetadataWritten   = "metadata-written"   // Secret metadata, such as tags, written
+	EventProductionBlocked = "production-blocked" // Production secret not written to non-production
+	EventProductionLeaked  = "production-leaked"  // Production secret found in non-production
+	EventSecretDeleted     = "secret-deleted"     // Secret, or its latest version, deleted
+)
+
+var (
+	lock sync.Mutex
+
+	// Chain of the last event written to chainPath, see Record
+	chain     string
+	chainPath string
+
+	// SyncID is recorded in events which do not set one
+	SyncID string
+)
+
+// An Event written to the audit log as a single JSON line. Secret values are never included, only
+// their Hash.
+type Event struct {
+	Time          time.Time `json:"time"`
+	SyncID        string    `json:"sync_id,omitempty"`
+	Event         string    `json:"event"`
+	System        string    `json:"system,omitempty"`
+	Identity      string    `json:"identity,omitempty"` // Identity the system is accessed with
+	Path          string    `json:"path,omitempty"`
+	Source        string    `json:"source,omitempty"` // Reference to the source of the change
+	VersionBefore string    `json:"version_before,omitempty"`
+	VersionAfter  string    `json:"version_after,omitempty"`
+	Hash          string    `json:"hash,omitempty"` // Hash of the data or metadata written or deleted
+	Environment   string    `json:"environment,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	Chain         string    `json:"chain,omitempty"` // See Record
+}
+
+// Record appends e to the file in AUDIT_LOG_FILE env variable, if defined, or writes it to standard
+// output if the file is Stdout. Time and SyncID are set if empty.
+//
+// If AUDIT_LOG_CHAIN env variable is true, e.Chain is set to the SHA-256 hash of the chain of the
+// previous event followed by the JSON line of e without chain, so changing or removing any event
+// breaks the chain of all events after it.
+func Record(e *Event) error {
+	path := helper.Getenv("", EnvFile)
+	if path == "" {
+		return nil
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.SyncID == "" {
+		e.SyncID = SyncID
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	e.Chain = ""
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if enabled, _ := strconv.ParseBool(helper.Getenv("", EnvChain)); enabled {
+		if path != chainPath {
+			chain, chainPath = lastChain(path), path
+		}
+
+		sum := sha256.Sum256(append([]byte(chain), line...))
+		e.Chain = "sha256:" + hex.EncodeToString(sum[:])
+
+		if line, err = json.Marshal(e); err != nil {
+			return err
+		}
+	}
+
+	if path == Stdout {
+		_, err = os.Stdout.Write(append(line, '\n'))
+	} else {
+		err = appendLine(path, line)
+	}
+
+	if err == nil && e.Chain != "" {
+		chain = e.Chain
+	}
+
+	return err
+}
+
+// SourceRef returns a reference to version of the secret id in the source system.
+func SourceRef(id, version string) string {
+	if id == "" || version == "" {
+		return id
+	}
+
+	return id + "@" + version
+}
+
+// appendLine appends line to the file in path.
+func appendLine(path string, line []byte) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// lastChain returns the chain of the last event in the file in path, or an empty string if there
+// is none, so the chain continues from earlier runs.
+func lastChain(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	var last string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Event
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			last = e.Chain
+		}
+	}
+
+	return last
+}
@@ -1,30 +1,65 @@
 package aws
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
+	"sync-secrets/pkg/audit"
 	"sync-secrets/pkg/helper"
+	"sync-secrets/pkg/redact"
+	"sync-secrets/pkg/report"
 	"sync-secrets/pkg/secret"
+	"sync-secrets/pkg/tags"
+	"sync-secrets/pkg/tracing"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/sts"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	EnvRegion  = "AWS_REGION"
-	EnvRoleArn = "AWS_ROLE_ARN"
-
-	DefaultRegion = "eu-central-1"
+	EnvBinaryKey = "AWS_BINARY_KEY"
+	EnvHashKey   = "HASH_KEY"
+	EnvHistory   = "SYNC_HISTORY"
+	EnvRegion    = "AWS_REGION"
+	EnvRoleArn   = "AWS_ROLE_ARN"
+	EnvStringKey = "AWS_STRING_KEY"
+
+	DefaultBinaryKey = "binary"
+	DefaultRegion    = "eu-central-1"
+	DefaultStringKey = "value"
+
+	StageCurrent  = "AWSCURRENT"
+	StagePrevious = "AWSPREVIOUS"
 )
 
+// TagLimits are the limits of Secrets Manager on tags.
+var TagLimits = tags.Limits{
+	MaxKeys:          50,
+	MaxKeyLength:     128,
+	MaxValueLength:   256,
+	ReservedPrefixes: []string{"aws:"},
+	Runes:            true,
+}
+
 type SecretsManager struct {
-	Config  *aws.Config
-	Client  *secretsmanager.SecretsManager
-	Region  string
-	RoleArn string
+	BinaryKey string
+	Config    *aws.Config
+	Client    *secretsmanager.SecretsManager
+	Context   context.Context // Parent of traced calls, such as the span of a sync job
+	DryRun    bool            // Changes are planned and reported, but nothing is written
+	Filter    *secret.Filter
+	HashKey   []byte // Key of content hashes in the audit log, no hashes if nil
+	History   int
+	Region    string
+	RoleArn   string
+	Secrets   []*secret.Secret
+	Session   *session.Session
+	StringKey string
+	TagRules  *tags.Rules // Rules of tags written, see CheckSecrets
 }
 
 // New returns a new SecretsManager struct. Configurations are read from environment variables. The
@@ -35,7 +70,7 @@ type SecretsManager struct {
 // For example, New("SOURCE_") will first get value from "SOURCE_AWS_REGION". If not found, tries to
 // get value from "AWS_REGION".
 func New(envPrefix string) *SecretsManager {
-	s := SecretsManager{}
+	s := SecretsManager{Context: context.Background()}
 
 	if e := helper.Getenv(envPrefix, EnvRegion); e != "" {
 		s.Region = e
@@ -47,10 +82,32 @@ func New(envPrefix string) *SecretsManager {
 		s.RoleArn = e
 	}
 
+	if e := helper.Getenv(envPrefix, EnvStringKey); e != "" {
+		s.StringKey = e
+	} else {
+		s.StringKey = DefaultStringKey
+	}
+
+	if e := helper.Getenv(envPrefix, EnvBinaryKey); e != "" {
+		s.BinaryKey = e
+	} else {
+		s.BinaryKey = DefaultBinaryKey
+	}
+
 	sess := session.Must(session.NewSession())
 	config := aws.Config{}
 	fields := log.Fields{"system": "AWS Secrets Manager"}
 
+	if e := helper.Getenv(envPrefix, EnvHashKey); e != "" {
+		s.HashKey = []byte(e)
+	}
+
+	history, err := secret.ParseHistory(helper.Getenv(envPrefix, EnvHistory))
+	if err != nil {
+		log.WithFields(fields).WithError(err).Fatalf("Invalid value for %s", envPrefix+EnvHistory)
+	}
+	s.History = history
+
 	config.Region = &s.Region
 	fields["region"] = s.Region
 
@@ -61,6 +118,7 @@ func New(envPrefix string) *SecretsManager {
 
 	s.Config = &config
 	s.Client = secretsmanager.New(sess, &config)
+	s.Session = sess
 
 	if _, err := sess.Config.Credentials.Get(); err != nil {
 		log.WithFields(fields).WithError(err).Fatal("Failed to create AWS session")
@@ -71,40 +129,301 @@ func New(envPrefix string) *SecretsManager {
 	return &s
 }
 
-// GetSecrets returns a Slice with all secrets from Secrets Manager which belong to env.
+// CheckSecrets maps the tags of new secrets with m.TagRules, and fails secrets exceeding the limits of
+// Secrets Manager on tags. The payload type of secrets other than a JSON object is set as the
+// TagPayloadType tag, so that they are read back as the same type.
+func (m *SecretsManager) CheckSecrets(newSecrets []*secret.Secret) {
+	m.TagRules.Apply(newSecrets)
+
+	for _, new := range newSecrets {
+		if new.Err != nil {
+			continue
+		}
+
+		if payloadType := new.Meta[secret.MetaPayloadType]; payloadType != "" && payloadType != PayloadJSON {
+			new.Tags[TagPayloadType] = payloadType
+		}
+
+		if err := TagLimits.Validate(new.Tags); err != nil {
+			new.Fail(fmt.Errorf("tags: %w", err))
+		}
+	}
+}
+
+// Identity returns the region of m, and the assumed role if any.
+func (m *SecretsManager) Identity() string {
+	if m.RoleArn != "" {
+		return m.Region + " " + m.RoleArn
+	}
+
+	return m.Region
+}
+
+// GetAllSecrets returns a Slice with all secrets in Secrets Manager, whatever their environment and
+// m.Filter. Only names and tags are read, not data.
+func (m *SecretsManager) GetAllSecrets() []*secret.Secret {
+	var secrets []*secret.Secret
+
+	ctx, span := tracing.StartBackend(m.Context, "secrets.list", "aws", "")
+	awsSecrets := m.ListSecrets(ctx, &secretsmanager.ListSecretsInput{})
+	tracing.End(span, nil)
+
+	for _, awsSecret := range awsSecrets {
+		s := secret.New(aws.StringValue(awsSecret.Name))
+		s.SourceID = aws.StringValue(awsSecret.ARN)
+		for _, awsTag := range awsSecret.Tags {
+			s.Tags[aws.StringValue(awsTag.Key)] = aws.StringValue(awsTag.Value)
+		}
+		s.SetEnv()
+		secrets = append(secrets, s)
+	}
+
+	return secrets
+}
+
+// GetCurrentSecrets returns a Slice with the latest versions of all secrets currently in Secrets
+// Manager, as they are compared to new secrets.
+func (m *SecretsManager) GetCurrentSecrets() []*secret.Secret {
+	return m.readSecrets(nil, secret.HistoryLatest)
+}
+
+// GetSecrets returns a Slice with all secrets from Secrets Manager which belong to env. Tags are as
+// in Secrets Manager, tag rules are applied by the destination in CheckSecrets.
 func (m *SecretsManager) GetSecrets(env *secret.Environment) []*secret.Secret {
+	return m.readSecrets(env, m.History)
+}
+
+// CleanRemovedSecrets compares each secret in newSecrets and m.Secrets. If a secret in the latter
+// does not exist in the prior, it is considered removed from the source system and will be deleted
+// from Secrets Manager as well. Deleted secrets can be restored during the default recovery window.
+// Secrets which could not be read are left untouched.
+func (m *SecretsManager) CleanRemovedSecrets(newSecrets []*secret.Secret) {
+	var removedSecrets uint32
+
+	for _, cur := range m.Secrets {
+		secretFound := false
+		for _, new := range newSecrets {
+			// Failed secrets are left untouched, so they are not considered removed either
+			if cur.EqualName(new) {
+				secretFound = true
+				break
+			}
+		}
+
+		if secretFound {
+			continue
+		}
+
+		if cur.Err != nil {
+			report.Record(cur.Name, report.ActionFailed, "", cur.Err)
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"path":   cur.Name,
+			"system": "AWS Secrets Manager",
+		}).Info("Secret removed from source system, removing also from Secrets Manager")
+		if err := m.deleteSecret(cur); err != nil {
+			report.Record(cur.Name, report.ActionFailed, "removed from source", err)
+		} else {
+			report.Record(cur.Name, report.ActionDeleted, "removed from source", nil)
+			if m.DryRun {
+				report.RecordKeys(cur.Name, secret.DiffKeys(nil, cur))
+			}
+			removedSecrets++
+		}
+	}
+
+	if removedSecrets > 0 {
+		log.WithFields(log.Fields{
+			"count":  removedSecrets,
+			"system": "AWS Secrets Manager",
+		}).Info("Successfully cleaned removed secrets")
+	}
+}
+
+// UpdateChangedSecrets compares each secret in newSecrets and m.Secrets. Secrets which do not exist
+// are created, and secrets with changed data or tags are updated. Failed secrets, and secrets which
+// could not be read from Secrets Manager, are skipped. With m.DryRun, the changes are only reported.
+func (m *SecretsManager) UpdateChangedSecrets(newSecrets []*secret.Secret) {
+	var updatedSecrets uint32
+
+	for _, new := range newSecrets {
+		var cur *secret.Secret
+		for _, s := range m.Secrets {
+			if new.EqualName(s) {
+				cur = s
+				break
+			}
+		}
+
+		if err := new.Err; err != nil || (cur != nil && cur.Err != nil) {
+			if err == nil {
+				err = cur.Err
+			}
+			log.WithFields(log.Fields{
+				"path":   new.Name,
+				"reason": err.Error(),
+				"system": "AWS Secrets Manager",
+			}).Info("Skipping secret")
+			report.Record(new.Name, report.ActionFailed, "", err)
+			continue
+		}
+
+		_, span := tracing.StartBackend(m.Context, "secret.compare", "aws", new.Name)
+		dataChanged := cur != nil && !new.EqualData(cur)
+		tagsChanged := cur != nil && !new.EqualTags(cur)
+		tracing.End(span, nil)
+
+		var err error
+		var updated bool
+		action := report.ActionUnchanged
+		if cur == nil {
+			err = m.createSecret(new)
+			updated = true
+			action = report.ActionCreated
+		} else {
+			if dataChanged {
+				err = m.putSecretValue(new, cur)
+				updated = true
+				action = report.ActionDataUpdated
+			}
+			if err == nil && tagsChanged {
+				err = m.putSecretTags(new, cur)
+				updated = true
+				if action == report.ActionUnchanged {
+					action = report.ActionTagsUpdated
+				}
+			}
+		}
+
+		if err != nil {
+			report.Record(new.Name, report.ActionFailed, "", err)
+		} else {
+			report.Record(new.Name, action, "", nil)
+			if m.DryRun {
+				report.RecordKeys(new.Name, secret.DiffKeys(new, cur))
+			}
+		}
+
+		if updated && err == nil {
+			updatedSecrets++
+		}
+	}
+
+	if updatedSecrets > 0 {
+		log.WithFields(log.Fields{
+			"count":  updatedSecrets,
+			"system": "AWS Secrets Manager",
+		}).Info("Successfully created and/or updated secrets")
+	} else {
+		log.WithFields(log.Fields{
+			"system": "AWS Secrets Manager",
+		}).Info("All secrets up to date")
+	}
+}
+
+// UpdateSecrets compares new secrets to those currently in Secrets Manager, updating any changed
+// and cleaning any removed. Secrets are checked with CheckSecrets first. Failed secrets are recorded
+// in the sync report, so no error is returned.
+func (m *SecretsManager) UpdateSecrets(newSecrets []*secret.Secret) error {
+	m.CheckSecrets(newSecrets)
+	m.Secrets = m.GetCurrentSecrets()
+	m.UpdateChangedSecrets(newSecrets)
+	m.CleanRemovedSecrets(newSecrets)
+
+	return nil
+}
+
+// Validate returns an error if the credentials are not valid. No secrets are read.
+func (m *SecretsManager) Validate() error {
+	identity, err := sts.New(m.Session, m.Config).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return fmt.Errorf("caller identity lookup failed: %w", err)
+	}
+
+	log.WithFields(log.Fields{
+		"arn":    aws.StringValue(identity.Arn),
+		"system": "AWS Secrets Manager",
+	}).Info("Credentials valid")
+
+	return nil
+}
+
+// readSecrets returns a Slice with all secrets from Secrets Manager which belong to env and match
+// m.Filter, including up to history versions of each.
+func (m *SecretsManager) readSecrets(env *secret.Environment, history int) []*secret.Secret {
 	if env == nil {
 		env = &secret.GlobalEnv
 	}
 
 	var secrets []*secret.Secret
 
-	input := &secretsmanager.ListSecretsInput{}
-	for _, awsSecret := range m.ListSecrets(input) {
+	ctx, span := tracing.StartBackend(m.Context, "secrets.list", "aws", "")
+	awsSecrets := m.ListSecrets(ctx, &secretsmanager.ListSecretsInput{})
+	tracing.End(span, nil)
+
+	for _, awsSecret := range awsSecrets {
 		s := secret.New(aws.StringValue(awsSecret.Name))
-		data := aws.StringValue(m.getSecretValue(awsSecret.ARN).SecretString)
+		s.SourceID = aws.StringValue(awsSecret.ARN)
 
 		// Transform [{"Key": "tag-key", "Value": "tag-value"}] to {"tag-key": "tag-value"}
 		for _, awsTag := range awsSecret.Tags {
 			s.Tags[aws.StringValue(awsTag.Key)] = aws.StringValue(awsTag.Value)
 		}
 
-		json.Unmarshal([]byte(data), &s.Data)
 		s.SetEnv()
 
-		if s.BelongsToEnv(env) {
-			if !env.IsGroup {
-				s.TrimNameEnv()
-			}
-			secrets = append(secrets, s)
+		if !s.BelongsToEnv(env) {
 			log.WithFields(log.Fields{
 				"system": "AWS Secrets Manager",
-			}).Debugf("Retrieving secret %s", s.Name)
-		} else {
+			}).Debugf("Ignoring secret %s", s.Name)
+			continue
+		}
+
+		// Filter before reading the value, so that a sync of a single secret reads only that one
+		if !env.IsGroup {
+			s.TrimNameEnv()
+		}
+		if !m.Filter.Matches(s) {
+			continue
+		}
+
+		// A secret which cannot be read is failed rather than left out, so that it's left untouched
+		// in the destination instead of taken as removed
+		ctx, span := tracing.StartBackend(m.Context, "secret.get", "aws", s.Name)
+		value, err := m.getSecretValue(ctx, awsSecret.ARN, nil)
+		if err != nil {
+			tracing.End(span, err)
+			s.Fail(fmt.Errorf("unable to read secret value: %w", err))
+			secrets = append(secrets, s)
+			continue
+		}
+
+		data, err := m.decodePayload(s, value)
+		if err != nil {
 			log.WithFields(log.Fields{
+				"path":   s.Name,
 				"system": "AWS Secrets Manager",
-			}).Debugf("Ignoring secret %s", s.Name)
+			}).WithError(err).Error("Unable to read secret payload")
+			tracing.End(span, err)
+			s.Fail(fmt.Errorf("unable to read secret payload: %w", err))
+			secrets = append(secrets, s)
+			continue
 		}
+
+		s.Version = aws.StringValue(value.VersionId)
+		s.AddData(data)
+
+		if history != secret.HistoryLatest {
+			s.History = m.getPreviousVersions(ctx, s, awsSecret)
+		}
+		tracing.End(span, nil)
+
+		secrets = append(secrets, s)
+		log.WithFields(log.Fields{
+			"system": "AWS Secrets Manager",
+		}).Debugf("Retrieving secret %s", s.Name)
 	}
 
 	log.WithFields(log.Fields{
@@ -115,78 +434,312 @@ func (m *SecretsManager) GetSecrets(env *secret.Environment) []*secret.Secret {
 	return secrets
 }
 
-// ListSecrets is a wrapper around AWS SDK's SecretsManager.ListSecrets()-function. Handles errors
-// and returns a SecretsManager.ListSecretsOutput.
-func (m *SecretsManager) ListSecrets(input *secretsmanager.ListSecretsInput) []*secretsmanager.SecretListEntry {
+// ListSecrets is a wrapper around AWS SDK's SecretsManager.ListSecretsWithContext()-function.
+// Handles errors and returns a SecretsManager.ListSecretsOutput.
+func (m *SecretsManager) ListSecrets(ctx context.Context, input *secretsmanager.ListSecretsInput) []*secretsmanager.SecretListEntry {
 	var secrets []*secretsmanager.SecretListEntry
-	output, err := m.Client.ListSecrets(input)
+	output, err := m.Client.ListSecretsWithContext(ctx, input)
 	if err != nil {
+		fields := log.Fields{"system": "AWS Secrets Manager"}
 		if aerr, ok := err.(awserr.Error); ok {
+			fields["code"] = aerr.Code()
 			switch aerr.Code() {
-			case secretsmanager.ErrCodeInvalidParameterException:
-				log.Error(secretsmanager.ErrCodeInvalidParameterException, aerr.Error())
-			case secretsmanager.ErrCodeInvalidNextTokenException:
-				log.Error(secretsmanager.ErrCodeInvalidNextTokenException, aerr.Error())
-			case secretsmanager.ErrCodeInternalServiceError:
-				log.Error(secretsmanager.ErrCodeInternalServiceError, aerr.Error())
-			default:
-				log.WithFields(log.Fields{
-					"system": "AWS Secrets Manager",
-				}).WithError(err).Fatal("Failed to list secrets")
+			case secretsmanager.ErrCodeInvalidParameterException,
+				secretsmanager.ErrCodeInvalidNextTokenException,
+				secretsmanager.ErrCodeInternalServiceError:
+				log.WithFields(fields).WithError(err).Error("Failed to list secrets")
+				return nil
 			}
-		} else {
-			log.WithFields(log.Fields{
-				"system": "AWS Secrets Manager",
-			}).WithError(err).Fatal("Unknown error while listing secrets")
 		}
 
-		return nil
+		log.WithFields(fields).WithError(err).Fatal("Failed to list secrets")
 	}
 
 	secrets = append(secrets, output.SecretList...)
 
 	if output.NextToken != nil {
 		input.SetNextToken(*output.NextToken)
-		secrets = append(secrets, m.ListSecrets(input)...)
+		secrets = append(secrets, m.ListSecrets(ctx, input)...)
 	}
 
 	return secrets
 }
 
-// getSecretValue is a wrapper around AWS SDK's SecretsManager.GetSecretValue()-function. Handles
-// errors and returns a SecretsManager.GetSecretValueOutput.
-func (m *SecretsManager) getSecretValue(arn *string) *secretsmanager.GetSecretValueOutput {
-	input := &secretsmanager.GetSecretValueInput{
-		SecretId: arn,
+// createSecret creates the secret s with its data and tags. With m.DryRun, nothing is written.
+func (m *SecretsManager) createSecret(s *secret.Secret) error {
+	fields := log.Fields{
+		"path":   s.Name,
+		"system": "AWS Secrets Manager",
 	}
 
-	secret, err := m.Client.GetSecretValue(input)
+	secretString, secretBinary, err := m.encodePayload(s)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case secretsmanager.ErrCodeResourceNotFoundException:
-				log.Error(secretsmanager.ErrCodeResourceNotFoundException, aerr.Error())
-			case secretsmanager.ErrCodeInvalidParameterException:
-				log.Error(secretsmanager.ErrCodeInvalidParameterException, aerr.Error())
-			case secretsmanager.ErrCodeInvalidRequestException:
-				log.Error(secretsmanager.ErrCodeInvalidRequestException, aerr.Error())
-			case secretsmanager.ErrCodeDecryptionFailure:
-				log.Error(secretsmanager.ErrCodeDecryptionFailure, aerr.Error())
-			case secretsmanager.ErrCodeInternalServiceError:
-				log.Error(secretsmanager.ErrCodeInternalServiceError, aerr.Error())
-			default:
+		log.WithFields(fields).WithError(err).Error("Unable to encode secret payload")
+		return err
+	}
+
+	if m.DryRun {
+		return nil
+	}
+
+	input := &secretsmanager.CreateSecretInput{
+		Name:         aws.String(s.Name),
+		SecretBinary: secretBinary,
+		SecretString: secretString,
+		Tags:         toAwsTags(s.Tags),
+	}
+
+	ctx, span := tracing.StartBackend(m.Context, "secret.create", "aws", s.Name)
+	output, err := m.Client.CreateSecretWithContext(ctx, input)
+	tracing.End(span, err)
+	if err != nil {
+		log.WithFields(fields).WithError(err).Error("Unable to create secret")
+		return err
+	}
+
+	log.WithFields(fields).Info("Succesfully created secret")
+
+	m.recordAudit(&audit.Event{
+		Event:        audit.EventDataWritten,
+		Path:         s.Name,
+		Source:       audit.SourceRef(s.SourceID, s.Version),
+		VersionAfter: aws.StringValue(output.VersionId),
+		Hash:         m.hash(s.Data),
+	})
+	m.recordAudit(&audit.Event{
+		Event:  audit.EventMetadataWritten,
+		Path:   s.Name,
+		Source: audit.SourceRef(s.SourceID, s.Version),
+		Hash:   m.hash(s.Tags),
+	})
+
+	return nil
+}
+
+// deleteSecret schedules the secret s for deletion after the default recovery window. With
+// m.DryRun, nothing is deleted.
+func (m *SecretsManager) deleteSecret(s *secret.Secret) error {
+	if m.DryRun {
+		return nil
+	}
+
+	ctx, span := tracing.StartBackend(m.Context, "secret.delete", "aws", s.Name)
+	_, err := m.Client.DeleteSecretWithContext(ctx, &secretsmanager.DeleteSecretInput{SecretId: aws.String(s.SourceID)})
+	tracing.End(span, err)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":   s.Name,
+			"system": "AWS Secrets Manager",
+		}).WithError(err).Error("Unable to delete secret")
+		return err
+	}
+
+	m.recordAudit(&audit.Event{
+		Event:         audit.EventSecretDeleted,
+		Path:          s.Name,
+		VersionBefore: s.Version,
+		Hash:          m.hash(s.Data),
+		Reason:        "removed from source",
+	})
+
+	return nil
+}
+
+// getPreviousVersions returns the version of awsSecret staged as AWSPREVIOUS, if one exists. Secrets
+// Manager only keeps track of the current and previous version, so at most one is returned. The
+// payload type is detected separately for the previous version, unless forced with a tag.
+func (m *SecretsManager) getPreviousVersions(ctx context.Context, s *secret.Secret, awsSecret *secretsmanager.SecretListEntry) []*secret.Version {
+	var versions []*secret.Version
+
+	for id, stages := range awsSecret.SecretVersionsToStages {
+		for _, stage := range stages {
+			if aws.StringValue(stage) != StagePrevious {
+				continue
+			}
+
+			value, err := m.getSecretValue(ctx, awsSecret.ARN, aws.String(id))
+			if err != nil {
+				continue
+			}
+
+			// Payload type of previous version may differ from the current one
+			previous := secret.New(s.Name)
+			previous.AddTags(s.Tags)
+
+			data, err := m.decodePayload(previous, value)
+			if err != nil {
 				log.WithFields(log.Fields{
-					"system": "AWS Secrets Manager",
-				}).WithError(err).Error("Failed to get secret value")
+					"path":    s.Name,
+					"system":  "AWS Secrets Manager",
+					"version": id,
+				}).WithError(err).Warn("Unable to read previous secret payload")
+				continue
 			}
-		} else {
-			log.WithFields(log.Fields{
-				"system": "AWS Secrets Manager",
-			}).WithError(err).Error("Unknown error while retrieving secret value")
+
+			redact.Register(data)
+			versions = append(versions, &secret.Version{ID: id, Data: data})
 		}
+	}
 
+	return versions
+}
+
+// hash returns the keyed hash of data with m.HashKey, see helper.HMAC, or an empty string if no key
+// is configured. Unkeyed hashes of secret values are never recorded.
+func (m *SecretsManager) hash(data interface{}) string {
+	if m.HashKey == nil {
+		return ""
+	}
+
+	return helper.HMAC(m.HashKey, data)
+}
+
+// putSecretTags replaces the tags of cur with the tags of s. With m.DryRun, nothing is written.
+func (m *SecretsManager) putSecretTags(s, cur *secret.Secret) error {
+	if m.DryRun {
 		return nil
 	}
 
-	return secret
+	fields := log.Fields{
+		"path":   s.Name,
+		"system": "AWS Secrets Manager",
+	}
+
+	ctx, span := tracing.StartBackend(m.Context, "secret.put-tags", "aws", s.Name)
+
+	var removed []*string
+	for key := range cur.Tags {
+		if !s.ContainsTag(key) {
+			removed = append(removed, aws.String(key))
+		}
+	}
+
+	if len(removed) > 0 {
+		input := &secretsmanager.UntagResourceInput{SecretId: aws.String(cur.SourceID), TagKeys: removed}
+		if _, err := m.Client.UntagResourceWithContext(ctx, input); err != nil {
+			log.WithFields(fields).WithError(err).Error("Unable to remove secret tags")
+			tracing.End(span, err)
+			return err
+		}
+	}
+
+	if len(s.Tags) > 0 {
+		input := &secretsmanager.TagResourceInput{SecretId: aws.String(cur.SourceID), Tags: toAwsTags(s.Tags)}
+		if _, err := m.Client.TagResourceWithContext(ctx, input); err != nil {
+			log.WithFields(fields).WithError(err).Error("Unable to update secret tags")
+			tracing.End(span, err)
+			return err
+		}
+	}
+
+	tracing.End(span, nil)
+	log.WithFields(fields).Info("Succesfully put tags to secret")
+
+	m.recordAudit(&audit.Event{
+		Event:  audit.EventMetadataWritten,
+		Path:   s.Name,
+		Source: audit.SourceRef(s.SourceID, s.Version),
+		Hash:   m.hash(s.Tags),
+	})
+
+	return nil
+}
+
+// putSecretValue writes the data of s as a new version of the existing secret cur. With m.DryRun,
+// nothing is written.
+func (m *SecretsManager) putSecretValue(s, cur *secret.Secret) error {
+	fields := log.Fields{
+		"path":   s.Name,
+		"system": "AWS Secrets Manager",
+	}
+
+	secretString, secretBinary, err := m.encodePayload(s)
+	if err != nil {
+		log.WithFields(fields).WithError(err).Error("Unable to encode secret payload")
+		return err
+	}
+
+	if m.DryRun {
+		return nil
+	}
+
+	input := &secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(cur.SourceID),
+		SecretBinary: secretBinary,
+		SecretString: secretString,
+	}
+
+	ctx, span := tracing.StartBackend(m.Context, "secret.put-data", "aws", s.Name)
+	output, err := m.Client.PutSecretValueWithContext(ctx, input)
+	tracing.End(span, err)
+	if err != nil {
+		log.WithFields(fields).WithError(err).Error("Unable to update secret value")
+		return err
+	}
+
+	log.WithFields(fields).Info("Succesfully put value to secret")
+
+	m.recordAudit(&audit.Event{
+		Event:         audit.EventDataWritten,
+		Path:          s.Name,
+		Source:        audit.SourceRef(s.SourceID, s.Version),
+		VersionBefore: cur.Version,
+		VersionAfter:  aws.StringValue(output.VersionId),
+		Hash:          m.hash(s.Data),
+	})
+
+	return nil
+}
+
+// recordAudit appends e to the audit log, with the system and identity of m.
+func (m *SecretsManager) recordAudit(e *audit.Event) {
+	e.System = "AWS Secrets Manager"
+	e.Identity = m.Identity()
+
+	if err := audit.Record(e); err != nil {
+		log.WithFields(log.Fields{
+			"path":   e.Path,
+			"system": "AWS Secrets Manager",
+		}).WithError(err).Error("Unable to write audit log")
+	}
+}
+
+// getSecretValue is a wrapper around AWS SDK's SecretsManager.GetSecretValueWithContext()-function.
+// Logs errors and returns a SecretsManager.GetSecretValueOutput. If versionId is nil, the version
+// staged as AWSCURRENT is returned.
+func (m *SecretsManager) getSecretValue(ctx context.Context, arn, versionId *string) (*secretsmanager.GetSecretValueOutput, error) {
+	input := &secretsmanager.GetSecretValueInput{
+		SecretId:  arn,
+		VersionId: versionId,
+	}
+
+	secret, err := m.Client.GetSecretValueWithContext(ctx, input)
+	if err != nil {
+		fields := log.Fields{
+			"arn":    aws.StringValue(arn),
+			"system": "AWS Secrets Manager",
+		}
+		if aerr, ok := err.(awserr.Error); ok {
+			fields["code"] = aerr.Code()
+		}
+
+		log.WithFields(fields).WithError(err).Error("Failed to get secret value")
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// toAwsTags transforms {"tag-key": "tag-value"} to [{"Key": "tag-key", "Value": "tag-value"}].
+func toAwsTags(tags map[string]interface{}) []*secretsmanager.Tag {
+	var awsTags []*secretsmanager.Tag
+
+	for key, val := range tags {
+		awsTags = append(awsTags, &secretsmanager.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(fmt.Sprintf("%v", val)),
+		})
+	}
+
+	return awsTags
 }
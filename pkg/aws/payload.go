@@ -0,0 +1,114 @@
+package aws
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync-secrets/pkg/helper"
+	"sync-secrets/pkg/secret"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+const (
+	// TagPayloadType forces the type of a secret's payload. The type of payloads other than a JSON
+	// object is recorded in secret.MetaPayloadType, whether forced or detected, and set as this tag
+	// when writing to Secrets Manager, see CheckSecrets.
+	TagPayloadType = "PayloadType"
+
+	PayloadBinary = "binary" // Payload in SecretBinary, or SecretString read as bytes
+	PayloadJSON   = "json"   // SecretString containing a JSON object
+	PayloadString = "string" // SecretString stored as is
+)
+
+// decodePayload returns the payload of value as secret data for s. A JSON object is returned as is,
+// with numbers as json.Number to keep them exactly as they are.
+// A plain string, such as a PEM certificate, is returned under m.StringKey, and a binary payload
+// base64-encoded under m.BinaryKey. The payload type is detected automatically unless forced with
+// the TagPayloadType tag of s, and recorded in the Meta of s unless a JSON object.
+func (m *SecretsManager) decodePayload(s *secret.Secret, value *secretsmanager.GetSecretValueOutput) (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+	payloadType := s.GetTagValue(TagPayloadType)
+
+	if payloadType == "" {
+		if value.SecretBinary != nil {
+			payloadType = PayloadBinary
+		} else if helper.DecodeJSON([]byte(aws.StringValue(value.SecretString)), &data) == nil {
+			return data, nil
+		} else {
+			payloadType = PayloadString
+		}
+	}
+
+	switch payloadType {
+	case PayloadBinary:
+		payload := value.SecretBinary
+		if payload == nil {
+			payload = []byte(aws.StringValue(value.SecretString))
+		}
+		data[m.BinaryKey] = base64.StdEncoding.EncodeToString(payload)
+
+	case PayloadString:
+		data[m.StringKey] = aws.StringValue(value.SecretString)
+
+	case PayloadJSON:
+		if err := helper.DecodeJSON([]byte(aws.StringValue(value.SecretString)), &data); err != nil {
+			return nil, fmt.Errorf("payload is not a JSON object: %w", err)
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown %s %s, should be one of: %s, %s, %s", TagPayloadType,
+			payloadType, PayloadJSON, PayloadString, PayloadBinary)
+	}
+
+	if payloadType != PayloadJSON {
+		s.Meta[secret.MetaPayloadType] = payloadType
+	}
+
+	return data, nil
+}
+
+// encodePayload returns the data of s as a SecretString or SecretBinary, doing the reverse mapping
+// of decodePayload according to the secret.MetaPayloadType of s, or its TagPayloadType tag. Without
+// either, data is encoded as a JSON object.
+func (m *SecretsManager) encodePayload(s *secret.Secret) (*string, []byte, error) {
+	payloadType := s.Meta[secret.MetaPayloadType]
+	if payloadType == "" {
+		payloadType = s.GetTagValue(TagPayloadType)
+	}
+
+	switch payloadType {
+	case PayloadBinary:
+		encoded, ok := s.Data[m.BinaryKey].(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("binary payload should be a base64 string under key %s", m.BinaryKey)
+		}
+		payload, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, nil, fmt.Errorf("binary payload is not valid base64: %w", err)
+		}
+		return nil, payload, nil
+
+	case PayloadString:
+		payload, ok := s.Data[m.StringKey].(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("string payload should be a string under key %s", m.StringKey)
+		}
+		return aws.String(payload), nil, nil
+
+	case "", PayloadJSON:
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(s.Data); err != nil {
+			return nil, nil, err
+		}
+		return aws.String(string(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))), nil, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unknown %s %s, should be one of: %s, %s, %s", TagPayloadType,
+			payloadType, PayloadJSON, PayloadString, PayloadBinary)
+	}
+}
@@ -0,0 +1,142 @@
+package aws
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync-secrets/pkg/secret"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// payloadSecret returns a secret with data and, if not empty, payloadType in its Meta.
+func payloadSecret(data map[string]interface{}, payloadType string) *secret.Secret {
+	s := secret.New("apps/cert")
+	s.AddData(data)
+	if payloadType != "" {
+		s.Meta[secret.MetaPayloadType] = payloadType
+	}
+
+	return s
+}
+
+func TestEncodePayload(t *testing.T) {
+	m := &SecretsManager{BinaryKey: DefaultBinaryKey, StringKey: DefaultStringKey}
+
+	tests := []struct {
+		name   string
+		secret *secret.Secret
+		string string // Expected SecretString, if any
+		binary []byte // Expected SecretBinary, if any
+		err    string
+	}{
+		{
+			name:   "string",
+			secret: payloadSecret(map[string]interface{}{"value": "-----BEGIN CERTIFICATE-----"}, PayloadString),
+			string: "-----BEGIN CERTIFICATE-----",
+		},
+		{
+			name:   "binary",
+			secret: payloadSecret(map[string]interface{}{"binary": "AAEC/w=="}, PayloadBinary),
+			binary: []byte{0, 1, 2, 255},
+		},
+		{
+			name:   "json",
+			secret: payloadSecret(map[string]interface{}{"user": "app", "port": json.Number("5432")}, ""),
+			string: `{"port":5432,"user":"app"}`,
+		},
+		{
+			name:   "json without escaping",
+			secret: payloadSecret(map[string]interface{}{"url": "a?b=1&c=<d>"}, PayloadJSON),
+			string: `{"url":"a?b=1&c=<d>"}`,
+		},
+		{
+			name: "forced with tag",
+			secret: func() *secret.Secret {
+				s := payloadSecret(map[string]interface{}{"value": "plain"}, "")
+				s.Tags[TagPayloadType] = PayloadString
+				return s
+			}(),
+			string: "plain",
+		},
+		{
+			name:   "string key missing",
+			secret: payloadSecret(map[string]interface{}{"other": "plain"}, PayloadString),
+			err:    "string payload should be a string under key value",
+		},
+		{
+			name:   "binary not base64",
+			secret: payloadSecret(map[string]interface{}{"binary": "not base64"}, PayloadBinary),
+			err:    "binary payload is not valid base64",
+		},
+		{
+			name:   "unknown type",
+			secret: payloadSecret(map[string]interface{}{"value": "plain"}, "yaml"),
+			err:    "unknown PayloadType yaml",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secretString, secretBinary, err := m.encodePayload(tt.secret)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("encodePayload() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("encodePayload() error = %v", err)
+			}
+
+			if tt.binary != nil {
+				if secretString != nil || !bytes.Equal(secretBinary, tt.binary) {
+					t.Errorf("encodePayload() = %v, %v, want binary %v", secretString, secretBinary, tt.binary)
+				}
+				return
+			}
+			if secretBinary != nil || aws.StringValue(secretString) != tt.string {
+				t.Errorf("encodePayload() = %q, %v, want string %q", aws.StringValue(secretString), secretBinary, tt.string)
+			}
+		})
+	}
+}
+
+func TestEncodePayloadReadsBack(t *testing.T) {
+	m := &SecretsManager{BinaryKey: DefaultBinaryKey, StringKey: DefaultStringKey}
+
+	for _, payloadType := range []string{PayloadString, PayloadBinary} {
+		t.Run(payloadType, func(t *testing.T) {
+			// A string payload which is also a JSON object is only read back as a string with the tag
+			data := map[string]interface{}{"value": `{"user":"app"}`, "binary": "AAEC/w=="}
+			new := payloadSecret(data, payloadType)
+			m.CheckSecrets([]*secret.Secret{new})
+			if new.Tags[TagPayloadType] != payloadType {
+				t.Fatalf("tag %s = %v, want %s", TagPayloadType, new.Tags[TagPayloadType], payloadType)
+			}
+
+			secretString, secretBinary, err := m.encodePayload(new)
+			if err != nil {
+				t.Fatalf("encodePayload() error = %v", err)
+			}
+
+			cur := secret.New(new.Name)
+			cur.AddTags(new.Tags)
+			value := &secretsmanager.GetSecretValueOutput{SecretString: secretString, SecretBinary: secretBinary}
+			got, err := m.decodePayload(cur, value)
+			if err != nil {
+				t.Fatalf("decodePayload() error = %v", err)
+			}
+
+			key := m.StringKey
+			if payloadType == PayloadBinary {
+				key = m.BinaryKey
+			}
+			if len(got) != 1 || got[key] != data[key] {
+				t.Errorf("decodePayload() = %v, want %s: %v", got, key, data[key])
+			}
+		})
+	}
+}
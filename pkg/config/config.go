@@ -0,0 +1,367 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync-secrets/pkg/secret"
+	"sync-secrets/pkg/tags"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	EnvFile = "CONFIG_FILE"
+
+	SystemAws   = "aws"
+	SystemVault = "vault"
+)
+
+var (
+	// ${NAME} is replaced with the value of env variable NAME, $${ is replaced with ${
+	interpolation = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	settingKey    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Config defines named source and destination systems, and the jobs syncing secrets between them.
+// Settings are the names of env variables (without SOURCE_ or DEST_ prefix) and their values.
+type Config struct {
+	Settings     map[string]string  `yaml:"settings,omitempty"`
+	Sources      map[string]*System `yaml:"sources"`
+	Destinations map[string]*System `yaml:"destinations"`
+	Jobs         []*Job             `yaml:"jobs"`
+}
+
+// A System secrets are synced from or to, with its settings.
+type System struct {
+	System   string            `yaml:"system"`
+	Settings map[string]string `yaml:"settings,omitempty"`
+}
+
+// A Job syncs the secrets of Environment matching Filters from Source to Destination.
+type Job struct {
+	Name        string         `yaml:"name"`
+	Source      string         `yaml:"source"`
+	Destination string         `yaml:"destination"`
+	Environment string         `yaml:"environment,omitempty"`
+	Filters     *secret.Filter `yaml:"filters,omitempty"`
+}
+
+// An Error in the config file, at the given line and column.
+type Error struct {
+	Path   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+// Error returns the error with its location, as "path:line:column: message".
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.Path, e.Line, e.Column, e.Msg)
+}
+
+// Load reads the config file in path. JSON files are accepted as well, as JSON is a subset of YAML.
+func Load(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(path, content)
+}
+
+// Parse parses content of the config file in path. Env variables are interpolated, and the config
+// is validated. Returns an *Error pointing to the invalid node, if any.
+func Parse(path string, content []byte) (*Config, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if len(root.Content) == 0 {
+		return nil, &Error{Path: path, Line: 1, Column: 1, Msg: "config is empty"}
+	}
+	doc := root.Content[0]
+
+	p := parser{path: path}
+	if err := p.interpolate(doc); err != nil {
+		return nil, err
+	}
+	if err := p.validateNode(doc, reflect.TypeOf(Config{})); err != nil {
+		return nil, err
+	}
+
+	var c Config
+	if err := doc.Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if err := p.validate(&c, doc); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// Job returns the job called name, or nil if there is none.
+func (c *Config) Job(name string) *Job {
+	for _, job := range c.Jobs {
+		if job.Name == name {
+			return job
+		}
+	}
+
+	return nil
+}
+
+// parser keeps the path of the config file for errors.
+type parser struct {
+	path string
+}
+
+// errorf returns an *Error at node.
+func (p *parser) errorf(node *yaml.Node, format string, a ...interface{}) error {
+	return &Error{Path: p.path, Line: node.Line, Column: node.Column, Msg: fmt.Sprintf(format, a...)}
+}
+
+// interpolate replaces ${NAME} in scalar values under node with the value of env variable NAME.
+// Undefined variables are an error.
+func (p *parser) interpolate(node *yaml.Node) error {
+	if node.Kind == yaml.MappingNode {
+		// Only values are interpolated, not keys
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := p.interpolate(node.Content[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, child := range node.Content {
+		if err := p.interpolate(child); err != nil {
+			return err
+		}
+	}
+
+	if node.Kind != yaml.ScalarNode || !strings.Contains(node.Value, "${") {
+		return nil
+	}
+
+	var err error
+	node.Value = interpolation.ReplaceAllStringFunc(node.Value, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+
+		name := match[2 : len(match)-1]
+		val, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = p.errorf(node, "env variable %s not defined", name)
+		}
+		return val
+	})
+	// The value is a string, whatever the variables contained
+	node.Tag = "!!str"
+	node.Style = 0
+
+	return err
+}
+
+// validate returns an error if c is not valid. Settings keys are upper-cased.
+func (p *parser) validate(c *Config, doc *yaml.Node) error {
+	c.Settings = upperKeys(c.Settings)
+
+	// Systems are validated in a fixed order, so that the same error is reported on every run
+	for _, kind := range []string{"sources", "destinations"} {
+		systems := c.Sources
+		if kind == "destinations" {
+			systems = c.Destinations
+		}
+
+		for _, name := range sortedKeys(systems) {
+			system := systems[name]
+			node := find(doc, kind, name)
+			if system == nil {
+				return p.errorf(node, "%s should not be empty", name)
+			}
+
+			switch system.System {
+			case SystemAws, SystemVault:
+			default:
+				return p.errorf(find(node, "system"), "system should be one of: %s, %s", SystemAws, SystemVault)
+			}
+
+			for _, key := range sortedKeys(system.Settings) {
+				if !settingKey.MatchString(key) {
+					return p.errorf(find(node, "settings", key), "invalid setting %s", key)
+				}
+				if kind == "sources" && strings.ToUpper(key) == tags.EnvRulesFile {
+					return p.errorf(find(node, "settings", key), "%s is applied by destinations only", key)
+				}
+			}
+			system.Settings = upperKeys(system.Settings)
+		}
+	}
+
+	jobsNode := find(doc, "jobs")
+	if len(c.Jobs) == 0 {
+		return p.errorf(jobsNode, "at least one job should be defined")
+	}
+
+	names := make(map[string]bool)
+	for i, job := range c.Jobs {
+		node := jobsNode.Content[i]
+		if job == nil {
+			return p.errorf(node, "job should not be empty")
+		}
+
+		if job.Name == "" {
+			return p.errorf(node, "name should be defined")
+		} else if names[job.Name] {
+			return p.errorf(find(node, "name"), "job %s defined more than once", job.Name)
+		}
+		names[job.Name] = true
+
+		if job.Source == "" {
+			return p.errorf(node, "source should be defined")
+		} else if _, ok := c.Sources[job.Source]; !ok {
+			return p.errorf(find(node, "source"), "source %s not defined", job.Source)
+		}
+
+		if job.Destination == "" {
+			return p.errorf(node, "destination should be defined")
+		} else if _, ok := c.Destinations[job.Destination]; !ok {
+			return p.errorf(find(node, "destination"), "destination %s not defined", job.Destination)
+		}
+
+		if job.Environment != "" && secret.GetEnvFromString(job.Environment) == nil {
+			return p.errorf(find(node, "environment"), "%s not accepted value for environment", job.Environment)
+		}
+	}
+
+	return nil
+}
+
+// validateNode returns an error if node cannot be decoded into a value of type t: it has an unknown
+// field, or a mapping, sequence or scalar where another is expected.
+func (p *parser) validateNode(node *yaml.Node, t reflect.Type) error {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return nil
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return p.errorf(node, "expected a mapping")
+		}
+
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			fields[name] = t.Field(i).Type
+		}
+
+		for i := 0; i < len(node.Content); i += 2 {
+			key, val := node.Content[i], node.Content[i+1]
+			fieldType, ok := fields[key.Value]
+			if !ok {
+				return p.errorf(key, "unknown field %s", key.Value)
+			}
+			if err := p.validateNode(val, fieldType); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return p.errorf(node, "expected a mapping")
+		}
+
+		for i := 0; i < len(node.Content); i += 2 {
+			if node.Content[i].Kind != yaml.ScalarNode {
+				return p.errorf(node.Content[i], "expected a scalar key")
+			}
+			if err := p.validateNode(node.Content[i+1], t.Elem()); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return p.errorf(node, "expected a sequence")
+		}
+
+		for _, child := range node.Content {
+			if err := p.validateNode(child, t.Elem()); err != nil {
+				return err
+			}
+		}
+
+	default:
+		if node.Kind != yaml.ScalarNode {
+			return p.errorf(node, "expected a scalar value")
+		}
+	}
+
+	return nil
+}
+
+// find returns the node under node at the path of mapping keys, or the deepest node found.
+func find(node *yaml.Node, keys ...string) *yaml.Node {
+	for _, key := range keys {
+		if node.Kind != yaml.MappingNode {
+			return node
+		}
+
+		found := false
+		for i := 0; i < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				node = node.Content[i+1]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return node
+		}
+	}
+
+	return node
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// upperKeys returns m with upper-cased keys.
+func upperKeys(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+
+	result := make(map[string]string, len(m))
+	for key, val := range m {
+		result[strings.ToUpper(key)] = val
+	}
+
+	return result
+}
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const validConfig = `
+settings:
+  log_level: debug
+sources:
+  aws:
+    system: aws
+    settings:
+      aws_region: ${TEST_REGION}
+destinations:
+  vault:
+    system: vault
+jobs:
+  - name: apps
+    source: aws
+    destination: vault
+    environment: dev
+    filters:
+      paths: ["apps/*"]
+      tags:
+        team: platform
+`
+
+func TestParse(t *testing.T) {
+	t.Setenv("TEST_REGION", "eu-west-1")
+
+	c, err := Parse("config.yaml", []byte(validConfig))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	if c.Settings["LOG_LEVEL"] != "debug" {
+		t.Errorf("Settings = %v, want upper-cased keys", c.Settings)
+	}
+	if got := c.Sources["aws"].Settings["AWS_REGION"]; got != "eu-west-1" {
+		t.Errorf("AWS_REGION = %q, want interpolated %q", got, "eu-west-1")
+	}
+
+	job := c.Job("apps")
+	if job == nil || job.Filters == nil {
+		t.Fatalf("Job(apps) = %+v, want a job with filters", job)
+	}
+	if len(job.Filters.Paths) != 1 || job.Filters.Tags["team"] != "platform" {
+		t.Errorf("Filters = %+v", job.Filters)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string // Location and message of the error
+	}{
+		{
+			name:    "empty",
+			content: "",
+			want:    "config.yaml:1:1: config is empty",
+		},
+		{
+			name:    "unknown field",
+			content: "sources: {}\njob:\n  - name: apps\n",
+			want:    "config.yaml:2:1: unknown field job",
+		},
+		{
+			name:    "unknown field in filters",
+			content: "jobs:\n  - name: apps\n    filters:\n      path: [apps/*]\n",
+			want:    "config.yaml:4:7: unknown field path",
+		},
+		{
+			name:    "mapping expected",
+			content: "sources:\n  aws: [aws]\n",
+			want:    "config.yaml:2:8: expected a mapping",
+		},
+		{
+			name:    "undefined env variable",
+			content: "settings:\n  region: eu-${TEST_UNDEFINED}\n",
+			want:    "config.yaml:2:11: env variable TEST_UNDEFINED not defined",
+		},
+		{
+			name:    "unknown source system",
+			content: "sources:\n  gcp:\n    system: gcp\njobs: []\n",
+			want:    "config.yaml:3:13: system should be one of: aws, vault",
+		},
+		{
+			name:    "unknown destination system",
+			content: "destinations:\n  gcp:\n    system: gcp\njobs: []\n",
+			want:    "config.yaml:3:13: system should be one of: aws, vault",
+		},
+		{
+			name:    "tag rules of source",
+			content: "sources:\n  aws:\n    system: aws\n    settings:\n      tag_rules_file: tags.json\njobs: []\n",
+			want:    "config.yaml:5:23: tag_rules_file is applied by destinations only",
+		},
+		{
+			name:    "invalid systems in order",
+			content: "sources:\n  b:\n    system: gcp\n  a:\n    system: gcp\njobs: []\n",
+			want:    "config.yaml:5:13: system should be one of: aws, vault",
+		},
+		{
+			name:    "no jobs",
+			content: "sources:\n  aws:\n    system: aws\njobs: []\n",
+			want:    "config.yaml:4:7: at least one job should be defined",
+		},
+		{
+			name: "undefined source",
+			content: "sources:\n  aws:\n    system: aws\ndestinations:\n  vault:\n    system: vault\n" +
+				"jobs:\n  - name: apps\n    source: gcp\n    destination: vault\n",
+			want: "config.yaml:9:13: source gcp not defined",
+		},
+		{
+			name: "missing destination",
+			content: "sources:\n  aws:\n    system: aws\n" +
+				"jobs:\n  - name: apps\n    source: aws\n",
+			want: "config.yaml:5:5: destination should be defined",
+		},
+		{
+			name: "duplicate job",
+			content: "sources:\n  aws:\n    system: aws\ndestinations:\n  vault:\n    system: vault\n" +
+				"jobs:\n  - {name: apps, source: aws, destination: vault}\n" +
+				"  - {name: apps, source: aws, destination: vault}\n",
+			want: "config.yaml:9:12: job apps defined more than once",
+		},
+		{
+			name: "invalid environment",
+			content: "sources:\n  aws:\n    system: aws\ndestinations:\n  vault:\n    system: vault\n" +
+				"jobs:\n  - name: apps\n    source: aws\n    destination: vault\n    environment: qa\n",
+			want: "config.yaml:11:18: qa not accepted value for environment",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse("config.yaml", []byte(tt.content))
+
+			var configErr *Error
+			if !errors.As(err, &configErr) {
+				t.Fatalf("Parse() error = %v, want an *Error", err)
+			}
+			if got := configErr.Error(); got != tt.want {
+				t.Errorf("Parse() error = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInvalidYAML(t *testing.T) {
+	_, err := Parse("config.yaml", []byte("jobs: [\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "config.yaml: yaml: line") {
+		t.Errorf("Parse() error = %v, want a YAML error with its line", err)
+	}
+}
@@ -0,0 +1,245 @@
+package derive
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync-secrets/pkg/helper"
+	"sync-secrets/pkg/secret"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const EnvRulesFile = "DERIVE_RULES_FILE"
+
+// A Rule adds derived keys to the secrets its Filter matches. Keys maps each derived key to a
+// text/template executed with the data of the secret. Other keys, including derived ones, can be
+// referenced with {{ ref "path" "key" }}.
+type Rule struct {
+	Name string `json:"name"`
+	secret.Filter
+	Keys map[string]string `json:"keys"`
+
+	templates map[string]*template.Template
+}
+
+// deriver evaluates derived keys of a set of secrets.
+type deriver struct {
+	failed   map[string]bool
+	rules    []*Rule
+	secrets  map[string]*secret.Secret
+	values   map[string]string
+	visiting map[string]bool
+}
+
+// Load reads derive rules from the JSON file in path and parses their templates.
+func Load(path string) ([]*Rule, error) {
+	var rules []*Rule
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := helper.DecodeJSON(content, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i, rule := range rules {
+		if err := rule.Parse(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d (%s): %w", path, i, rule.Name, err)
+		}
+	}
+
+	return rules, nil
+}
+
+// Apply adds the derived keys of each rule to the data of the secrets it matches, and of all their
+// history versions. References are resolved within secrets, to their current versions. If a key
+// cannot be derived, because of a missing reference or a cycle, the secret is failed.
+func Apply(rules []*Rule, secrets []*secret.Secret) {
+	d := &deriver{
+		failed:   make(map[string]bool),
+		rules:    rules,
+		secrets:  make(map[string]*secret.Secret),
+		values:   make(map[string]string),
+		visiting: make(map[string]bool),
+	}
+
+	for _, s := range secrets {
+		d.secrets[s.Name] = s
+		if s.Err != nil {
+			d.failed[s.Name] = true
+		}
+	}
+
+	derived := make(map[*secret.Secret]map[string]string)
+	derivedHistory := make(map[*secret.Version]map[string]string)
+	for _, s := range secrets {
+		if s.Err != nil {
+			continue
+		}
+
+		keys := d.derivedKeys(s)
+		if len(keys) == 0 {
+			continue
+		}
+
+		values := make(map[string]string)
+		for _, key := range keys {
+			val, err := d.resolve(s.Name, key)
+			if err != nil {
+				s.Fail(fmt.Errorf("derive %s: %w", key, err))
+				break
+			}
+			values[key] = val
+		}
+
+		if s.Err != nil {
+			continue
+		}
+		derived[s] = values
+
+		for _, version := range s.History {
+			values, err := d.deriveVersion(s, version.Data, keys)
+			if err != nil {
+				s.Fail(fmt.Errorf("version %s: %w", version.ID, err))
+				delete(derived, s)
+				break
+			}
+			derivedHistory[version] = values
+		}
+	}
+
+	// Data is only changed after all keys are derived, so that templates see the source data
+	for s, values := range derived {
+		for key, val := range values {
+			s.Data[key] = val
+		}
+		for _, version := range s.History {
+			for key, val := range derivedHistory[version] {
+				version.Data[key] = val
+			}
+		}
+
+		log.WithFields(log.Fields{
+			"path": s.Name,
+		}).Debugf("Derived %d keys", len(values))
+	}
+}
+
+// Parse parses the templates of the rule.
+func (r *Rule) Parse() error {
+	if len(r.Keys) == 0 {
+		return fmt.Errorf("keys should not be empty")
+	}
+
+	r.templates = make(map[string]*template.Template)
+	for key, text := range r.Keys {
+		tmpl, err := template.New(key).
+			Option("missingkey=error").
+			Funcs(template.FuncMap{"ref": func(string, string) (string, error) { return "", nil }}).
+			Parse(text)
+		if err != nil {
+			return err
+		}
+		r.templates[key] = tmpl
+	}
+
+	return nil
+}
+
+// deriveVersion returns keys derived from data, the data of a history version of s. References are
+// resolved to current versions.
+func (d *deriver) deriveVersion(s *secret.Secret, data map[string]interface{}, keys []string) (map[string]string, error) {
+	values := make(map[string]string)
+
+	for _, key := range keys {
+		var b strings.Builder
+		err := d.template(s, key).Funcs(template.FuncMap{"ref": d.resolve}).Execute(&b, data)
+		if err != nil {
+			return nil, fmt.Errorf("derive %s: %w", key, err)
+		}
+		values[key] = b.String()
+	}
+
+	return values, nil
+}
+
+// derivedKeys returns the sorted derived keys of s.
+func (d *deriver) derivedKeys(s *secret.Secret) []string {
+	var keys []string
+	seen := make(map[string]bool)
+
+	for _, rule := range d.rules {
+		if !rule.Matches(s) {
+			continue
+		}
+		for key := range rule.Keys {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// resolve returns the value of key in the secret name, deriving it if needed.
+func (d *deriver) resolve(name, key string) (string, error) {
+	id := name + "#" + key
+	if val, ok := d.values[id]; ok {
+		return val, nil
+	}
+
+	s, ok := d.secrets[name]
+	if !ok {
+		return "", fmt.Errorf("secret %s not found", name)
+	}
+	if d.failed[name] {
+		return "", fmt.Errorf("secret %s failed", name)
+	}
+
+	tmpl := d.template(s, key)
+	if tmpl == nil {
+		val, ok := s.Data[key]
+		if !ok {
+			return "", fmt.Errorf("key %s not found in secret %s", key, name)
+		}
+		return fmt.Sprint(val), nil
+	}
+
+	if d.visiting[id] {
+		return "", fmt.Errorf("cycle in reference to %s in secret %s", key, name)
+	}
+	d.visiting[id] = true
+	defer delete(d.visiting, id)
+
+	var b strings.Builder
+	err := tmpl.Funcs(template.FuncMap{"ref": d.resolve}).Execute(&b, s.Data)
+	if err != nil {
+		return "", err
+	}
+
+	d.values[id] = b.String()
+
+	return d.values[id], nil
+}
+
+// template returns the template deriving key in s, or nil if key is not derived. If more than one
+// rule derives key, the last one is used.
+func (d *deriver) template(s *secret.Secret, key string) *template.Template {
+	var tmpl *template.Template
+
+	for _, rule := range d.rules {
+		if t, ok := rule.templates[key]; ok && rule.Matches(s) {
+			tmpl = t
+		}
+	}
+
+	return tmpl
+}
@@ -0,0 +1,198 @@
+package derive
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync-secrets/pkg/secret"
+	"testing"
+)
+
+// rule returns a parsed rule deriving keys in secrets matching paths, or all secrets if none.
+func rule(t *testing.T, keys map[string]string, paths ...string) *Rule {
+	t.Helper()
+
+	r := &Rule{Name: "test", Filter: secret.Filter{Paths: paths}, Keys: keys}
+	if err := r.Parse(); err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	return r
+}
+
+func TestApply(t *testing.T) {
+	data := map[string]map[string]interface{}{
+		"apps/db":   {"user": "app", "password": "p4ssw0rd"},
+		"shared/db": {"host": "db.internal", "port": "5432"},
+	}
+
+	tests := []struct {
+		name  string
+		rules func(t *testing.T) []*Rule
+		want  map[string]map[string]interface{} // Data of each secret after deriving
+		err   string                            // Reason apps/db is failed for, if any
+	}{
+		{
+			name: "own data",
+			rules: func(t *testing.T) []*Rule {
+				return []*Rule{rule(t, map[string]string{"login": "{{ .user }}:{{ .password }}"}, "apps/*")}
+			},
+			want: map[string]map[string]interface{}{
+				"apps/db":   {"user": "app", "password": "p4ssw0rd", "login": "app:p4ssw0rd"},
+				"shared/db": data["shared/db"],
+			},
+		},
+		{
+			name: "reference to another secret",
+			rules: func(t *testing.T) []*Rule {
+				return []*Rule{rule(t, map[string]string{
+					"dsn": `postgres://{{ .user }}@{{ ref "shared/db" "host" }}:{{ ref "shared/db" "port" }}/app`,
+				}, "apps/*")}
+			},
+			want: map[string]map[string]interface{}{
+				"apps/db":   {"user": "app", "password": "p4ssw0rd", "dsn": "postgres://app@db.internal:5432/app"},
+				"shared/db": data["shared/db"],
+			},
+		},
+		{
+			name: "reference to a derived key",
+			rules: func(t *testing.T) []*Rule {
+				return []*Rule{
+					rule(t, map[string]string{"url": `https://{{ ref "shared/db" "addr" }}`}, "apps/*"),
+					rule(t, map[string]string{"addr": "{{ .host }}:{{ .port }}"}, "shared/*"),
+				}
+			},
+			want: map[string]map[string]interface{}{
+				"apps/db":   {"user": "app", "password": "p4ssw0rd", "url": "https://db.internal:5432"},
+				"shared/db": {"host": "db.internal", "port": "5432", "addr": "db.internal:5432"},
+			},
+		},
+		{
+			name: "templates see source data",
+			rules: func(t *testing.T) []*Rule {
+				return []*Rule{rule(t, map[string]string{"user": "{{ .user }}-ro", "login": "{{ .user }}"}, "apps/*")}
+			},
+			want: map[string]map[string]interface{}{
+				"apps/db":   {"user": "app-ro", "password": "p4ssw0rd", "login": "app"},
+				"shared/db": data["shared/db"],
+			},
+		},
+		{
+			name: "cycle",
+			rules: func(t *testing.T) []*Rule {
+				return []*Rule{rule(t, map[string]string{
+					"a": `{{ ref "apps/db" "b" }}`,
+					"b": `{{ ref "apps/db" "a" }}`,
+				}, "apps/*")}
+			},
+			err: "cycle in reference to a in secret apps/db",
+		},
+		{
+			name: "missing secret",
+			rules: func(t *testing.T) []*Rule {
+				return []*Rule{rule(t, map[string]string{"dsn": `{{ ref "shared/cache" "host" }}`}, "apps/*")}
+			},
+			err: "secret shared/cache not found",
+		},
+		{
+			name: "missing key",
+			rules: func(t *testing.T) []*Rule {
+				return []*Rule{rule(t, map[string]string{"dsn": `{{ ref "shared/db" "name" }}`}, "apps/*")}
+			},
+			err: "key name not found in secret shared/db",
+		},
+		{
+			name: "missing own key",
+			rules: func(t *testing.T) []*Rule {
+				return []*Rule{rule(t, map[string]string{"login": "{{ .name }}"}, "apps/*")}
+			},
+			err: `map has no entry for key "name"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var secrets []*secret.Secret
+			for _, name := range []string{"apps/db", "shared/db"} {
+				s := secret.New(name)
+				for key, val := range data[name] {
+					s.Data[key] = val
+				}
+				secrets = append(secrets, s)
+			}
+
+			Apply(tt.rules(t), secrets)
+
+			if tt.err != "" {
+				if err := secrets[0].Err; err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("Apply() failed apps/db with %v, want %q", err, tt.err)
+				}
+				return
+			}
+			for _, s := range secrets {
+				if s.Err != nil {
+					t.Errorf("Apply() failed %s with %v", s.Name, s.Err)
+				} else if !reflect.DeepEqual(s.Data, tt.want[s.Name]) {
+					t.Errorf("Apply() data of %s = %v, want %v", s.Name, s.Data, tt.want[s.Name])
+				}
+			}
+		})
+	}
+}
+
+func TestApplyFailedSecrets(t *testing.T) {
+	failed := secret.New("shared/db")
+	failed.Data["host"] = "db.internal"
+	failed.Fail(errors.New("unreadable"))
+	s := secret.New("apps/db")
+
+	Apply([]*Rule{rule(t, map[string]string{"host": `{{ ref "shared/db" "host" }}`})}, []*secret.Secret{s, failed})
+
+	if want := "secret shared/db failed"; s.Err == nil || !strings.Contains(s.Err.Error(), want) {
+		t.Errorf("Apply() failed apps/db with %v, want %q", s.Err, want)
+	}
+	if keys := dataKeys(failed); !reflect.DeepEqual(keys, []string{"host"}) {
+		t.Errorf("Apply() keys of failed secret = %v, want it skipped", keys)
+	}
+}
+
+func TestApplyHistory(t *testing.T) {
+	s := secret.New("apps/db")
+	s.Data = map[string]interface{}{"user": "app", "password": "new"}
+	s.History = []*secret.Version{{ID: "1", Data: map[string]interface{}{"user": "app", "password": "old"}}}
+	shared := secret.New("shared/db")
+	shared.Data["host"] = "db.internal"
+	broken := secret.New("apps/cache")
+	broken.Data = map[string]interface{}{"user": "app", "password": "new"}
+	broken.History = []*secret.Version{{ID: "1", Data: map[string]interface{}{"user": "app"}}}
+
+	rules := []*Rule{rule(t, map[string]string{
+		"dsn": `{{ .user }}:{{ .password }}@{{ ref "shared/db" "host" }}`,
+	}, "apps/*")}
+	Apply(rules, []*secret.Secret{s, shared, broken})
+
+	if got, want := s.Data["dsn"], "app:new@db.internal"; got != want {
+		t.Errorf("Apply() dsn = %v, want %v", got, want)
+	}
+	if got, want := s.History[0].Data["dsn"], "app:old@db.internal"; got != want {
+		t.Errorf("Apply() dsn of version 1 = %v, want %v", got, want)
+	}
+	if want := "version 1: derive dsn"; broken.Err == nil || !strings.Contains(broken.Err.Error(), want) {
+		t.Errorf("Apply() failed apps/cache with %v, want %q", broken.Err, want)
+	}
+	if _, ok := broken.Data["dsn"]; ok {
+		t.Errorf("Apply() data of apps/cache = %v, want it unchanged", broken.Data)
+	}
+}
+
+// dataKeys returns the sorted data keys of s.
+func dataKeys(s *secret.Secret) []string {
+	var keys []string
+	for key := range s.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
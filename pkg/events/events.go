@@ -0,0 +1,260 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync-secrets/pkg/helper"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EnvEndpoint = "SQS_ENDPOINT"
+	EnvQueueURL = "SQS_QUEUE_URL"
+	EnvRegion   = "AWS_REGION"
+	EnvRoleArn  = "AWS_ROLE_ARN"
+
+	DefaultRegion = "eu-central-1"
+
+	EventDeleteSecret       = "DeleteSecret"
+	EventPutSecretValue     = "PutSecretValue"
+	EventRotationSucceeded  = "RotationSucceeded"
+	EventTagResource        = "TagResource"
+	EventUpdateSecret       = "UpdateSecret"
+	sourceSecretsManager    = "aws.secretsmanager"
+	maxMessages             = 10
+	maxWaitTime             = 20 * time.Second
+	secretArnResourcePrefix = "secret:"
+)
+
+// secretArnSuffix is the dash and 6 random characters Secrets Manager appends to names in full ARNs
+var secretArnSuffix = regexp.MustCompile(`-[A-Za-z0-9]{6}$`)
+
+// Events lists the events of Secrets Manager which change a secret
+var Events = []string{
+	EventDeleteSecret,
+	EventPutSecretValue,
+	EventRotationSucceeded,
+	EventTagResource,
+	EventUpdateSecret,
+}
+
+// A Listener receives change events of Secrets Manager from an SQS queue, where EventBridge
+// delivers them. Secrets identified by a partial ARN are looked up in Secrets.
+type Listener struct {
+	Client   *sqs.SQS
+	QueueURL string
+	Secrets  *secretsmanager.SecretsManager
+}
+
+// An Event changing the secret called Secret.
+type Event struct {
+	Name   string // Name of the event, one of Events
+	Secret string // Name of the changed secret, empty until resolved if only ARN is known
+	ARN    string // ARN the secret is identified with, full or partial, if any
+
+	receipt *string
+}
+
+// An eventBridgeEvent of Secrets Manager, recorded by CloudTrail.
+type eventBridgeEvent struct {
+	Source string `json:"source"`
+	Detail struct {
+		EventName         string `json:"eventName"`
+		RequestParameters struct {
+			SecretID string `json:"secretId"`
+			Name     string `json:"name"`
+		} `json:"requestParameters"`
+		ResponseElements struct {
+			ARN string `json:"arn"`
+		} `json:"responseElements"`
+		AdditionalEventData struct {
+			SecretID string `json:"SecretId"`
+		} `json:"additionalEventData"`
+	} `json:"detail"`
+}
+
+// New returns a new Listener. Configurations are read from environment variables, with envPrefix
+// as in aws.New. The queue is read from SQS_QUEUE_URL, and SQS_ENDPOINT replaces the endpoint of
+// SQS, e.g. for an SQS-compatible server run locally.
+func New(envPrefix string) *Listener {
+	l := Listener{}
+	fields := log.Fields{"system": "AWS SQS"}
+
+	if e := helper.Getenv(envPrefix, EnvQueueURL); e != "" {
+		l.QueueURL = e
+		fields["queue"] = e
+	} else {
+		log.WithFields(fields).Fatalf("Required env variable %s not defined", envPrefix+EnvQueueURL)
+	}
+
+	config := aws.Config{Region: aws.String(DefaultRegion)}
+	if e := helper.Getenv(envPrefix, EnvRegion); e != "" {
+		config.Region = aws.String(e)
+	}
+	if e := helper.Getenv(envPrefix, EnvEndpoint); e != "" {
+		config.Endpoint = aws.String(e)
+	}
+
+	sess := session.Must(session.NewSession())
+	if e := helper.Getenv(envPrefix, EnvRoleArn); e != "" {
+		config.Credentials = stscreds.NewCredentials(sess, e)
+	}
+
+	l.Client = sqs.New(sess, &config)
+
+	// The endpoint replaces only that of SQS
+	secretsConfig := config.Copy()
+	secretsConfig.Endpoint = nil
+	l.Secrets = secretsmanager.New(sess, secretsConfig)
+
+	log.WithFields(fields).Info("Listening to Secrets Manager events")
+
+	return &l
+}
+
+// Parse returns the Event in body, the JSON of an EventBridge event. Returns an error if body is
+// not an event of Secrets Manager listed in Events. A secret identified in the request by an ARN,
+// which may be partial, is named after the full ARN in the response, if any. Otherwise its name is
+// left empty, to be resolved with Resolve.
+func Parse(body string) (*Event, error) {
+	var e eventBridgeEvent
+	if err := json.Unmarshal([]byte(body), &e); err != nil {
+		return nil, err
+	}
+
+	if e.Source != sourceSecretsManager {
+		return nil, fmt.Errorf("unsupported event source %q", e.Source)
+	}
+
+	if !helper.Contains(Events, e.Detail.EventName) {
+		return nil, fmt.Errorf("unsupported event %q", e.Detail.EventName)
+	}
+
+	id := e.Detail.RequestParameters.SecretID
+	if id == "" {
+		id = e.Detail.AdditionalEventData.SecretID
+	}
+	if id == "" {
+		id = e.Detail.RequestParameters.Name
+	}
+	if id == "" {
+		return nil, errors.New("secret not identified in event")
+	}
+
+	if !strings.HasPrefix(id, "arn:") {
+		return &Event{Name: e.Detail.EventName, Secret: id}, nil
+	}
+
+	event := &Event{Name: e.Detail.EventName, ARN: id}
+	if arn := e.Detail.ResponseElements.ARN; arn != "" {
+		event.Secret = SecretName(arn)
+	}
+
+	return event, nil
+}
+
+// SecretName returns the name of the secret identified by id, its name or full ARN. In a full ARN,
+// the name is followed by a dash and 6 random characters, which are removed. A partial ARN has no
+// such suffix, and cannot be told apart when the name ends alike, so it must be resolved instead.
+func SecretName(id string) string {
+	if !strings.HasPrefix(id, "arn:") {
+		return id
+	}
+
+	return secretArnSuffix.ReplaceAllString(resourceName(id), "")
+}
+
+// Resolve sets the name of the secret of e from its ARN, as described in Secrets Manager. If the
+// secret cannot be described, such as when deleted for good, the ARN is taken as partial and its
+// resource name is used as is.
+func (l *Listener) Resolve(ctx context.Context, e *Event) {
+	if e.Secret != "" || e.ARN == "" {
+		return
+	}
+
+	output, err := l.Secrets.DescribeSecretWithContext(ctx, &secretsmanager.DescribeSecretInput{
+		SecretId: aws.String(e.ARN),
+	})
+	if err == nil {
+		e.Secret = aws.StringValue(output.Name)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"arn":    e.ARN,
+		"system": "AWS Secrets Manager",
+	}).WithError(err).Warn("Unable to describe secret, taking its ARN as partial")
+
+	e.Secret = resourceName(e.ARN)
+}
+
+// Delete deletes the message of e from the queue, so it is not received again.
+func (l *Listener) Delete(e *Event) error {
+	_, err := l.Client.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(l.QueueURL),
+		ReceiptHandle: e.receipt,
+	})
+
+	return err
+}
+
+// Receive returns the events received from the queue within wait, at most 20 seconds. Messages
+// which are not supported events are logged and deleted. The messages of events returned should be
+// deleted with Delete once the events are handled, or they are received again.
+func (l *Listener) Receive(ctx context.Context, wait time.Duration) ([]*Event, error) {
+	if wait > maxWaitTime {
+		wait = maxWaitTime
+	}
+
+	output, err := l.Client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(l.QueueURL),
+		MaxNumberOfMessages: aws.Int64(maxMessages),
+		WaitTimeSeconds:     aws.Int64(int64(wait / time.Second)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*Event
+	for _, message := range output.Messages {
+		fields := log.Fields{"message": aws.StringValue(message.MessageId), "system": "AWS SQS"}
+
+		e, err := Parse(aws.StringValue(message.Body))
+		if err != nil {
+			log.WithFields(fields).WithError(err).Warn("Ignoring message")
+
+			if err := l.Delete(&Event{receipt: message.ReceiptHandle}); err != nil {
+				log.WithFields(fields).WithError(err).Error("Unable to delete message")
+			}
+			continue
+		}
+
+		l.Resolve(ctx, e)
+		e.receipt = message.ReceiptHandle
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+// resourceName returns the name of the secret in arn, with the suffix of a full ARN if any. Returns
+// arn if it's not the ARN of a secret.
+func resourceName(arn string) string {
+	i := strings.Index(arn, ":"+secretArnResourcePrefix)
+	if i < 0 {
+		return arn
+	}
+
+	return arn[i+len(secretArnResourcePrefix)+1:]
+}
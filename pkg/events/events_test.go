@@ -0,0 +1,119 @@
+package events
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want *Event
+	}{
+		{
+			name: "name in request",
+			body: `{"source": "aws.secretsmanager", "detail": {"eventName": "PutSecretValue",
+				"requestParameters": {"secretId": "apps/db"}}}`,
+			want: &Event{Name: EventPutSecretValue, Secret: "apps/db"},
+		},
+		{
+			name: "full ARN in request and response",
+			body: `{"source": "aws.secretsmanager", "detail": {"eventName": "UpdateSecret",
+				"requestParameters": {"secretId": "arn:aws:secretsmanager:eu-west-1:123456789012:secret:apps/db-AbCdEf"},
+				"responseElements": {"arn": "arn:aws:secretsmanager:eu-west-1:123456789012:secret:apps/db-AbCdEf"}}}`,
+			want: &Event{
+				Name:   EventUpdateSecret,
+				Secret: "apps/db",
+				ARN:    "arn:aws:secretsmanager:eu-west-1:123456789012:secret:apps/db-AbCdEf",
+			},
+		},
+		{
+			name: "partial ARN in request, full ARN in response",
+			body: `{"source": "aws.secretsmanager", "detail": {"eventName": "PutSecretValue",
+				"requestParameters": {"secretId": "arn:aws:secretsmanager:eu-west-1:123456789012:secret:apps/db-legacy"},
+				"responseElements": {"arn": "arn:aws:secretsmanager:eu-west-1:123456789012:secret:apps/db-legacy-AbCdEf"}}}`,
+			want: &Event{
+				Name:   EventPutSecretValue,
+				Secret: "apps/db-legacy",
+				ARN:    "arn:aws:secretsmanager:eu-west-1:123456789012:secret:apps/db-legacy",
+			},
+		},
+		{
+			name: "partial ARN without response is resolved later",
+			body: `{"source": "aws.secretsmanager", "detail": {"eventName": "TagResource",
+				"requestParameters": {"secretId": "arn:aws:secretsmanager:eu-west-1:123456789012:secret:apps/db-legacy"}}}`,
+			want: &Event{
+				Name: EventTagResource,
+				ARN:  "arn:aws:secretsmanager:eu-west-1:123456789012:secret:apps/db-legacy",
+			},
+		},
+		{
+			name: "rotation identifies the secret in additional data",
+			body: `{"source": "aws.secretsmanager", "detail": {"eventName": "RotationSucceeded",
+				"additionalEventData": {"SecretId": "apps/db"}}}`,
+			want: &Event{Name: EventRotationSucceeded, Secret: "apps/db"},
+		},
+		{
+			name: "name of deleted secret",
+			body: `{"source": "aws.secretsmanager", "detail": {"eventName": "DeleteSecret",
+				"requestParameters": {"name": "apps/db"}}}`,
+			want: &Event{Name: EventDeleteSecret, Secret: "apps/db"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.body)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if got.Name != tt.want.Name || got.Secret != tt.want.Secret || got.ARN != tt.want.ARN {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"invalid JSON", `{"source": `},
+		{"other source", `{"source": "aws.ssm", "detail": {"eventName": "PutSecretValue",
+			"requestParameters": {"secretId": "apps/db"}}}`},
+		{"unsupported event", `{"source": "aws.secretsmanager", "detail": {"eventName": "GetSecretValue",
+			"requestParameters": {"secretId": "apps/db"}}}`},
+		{"no secret", `{"source": "aws.secretsmanager", "detail": {"eventName": "PutSecretValue"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Parse(tt.body); err == nil {
+				t.Errorf("Parse() = %+v, want error", got)
+			}
+		})
+	}
+}
+
+func TestSecretName(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"apps/db", "apps/db"},
+		{"apps/db-AbCdEf", "apps/db-AbCdEf"},
+		{"arn:aws:secretsmanager:eu-west-1:123456789012:secret:apps/db-AbCdEf", "apps/db"},
+		{"arn:aws:secretsmanager:eu-west-1:123456789012:secret:db-password-x1Y2z3", "db-password"},
+		{"arn:aws:secretsmanager:eu-west-1:123456789012:secret:apps/db", "apps/db"},
+		{"arn:aws:secretsmanager:eu-west-1:123456789012:secret:apps/db-legacy-AbCdEf", "apps/db-legacy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if got := SecretName(tt.id); got != tt.want {
+				t.Errorf("SecretName(%q) = %q, want %q", tt.id, got, tt.want)
+			}
+		})
+	}
+}
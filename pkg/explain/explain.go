@@ -0,0 +1,176 @@
+package explain
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync-secrets/pkg/secret"
+)
+
+const (
+	SourceName = "name" // Environment detected from the name suffix
+	SourceNone = "none" // No environment detected
+	SourceTags = "tags" // Environment detected from the Environment tag
+)
+
+// A Target a secret may be synced to: the environment and filter of a job.
+type Target struct {
+	Job         string
+	Environment *secret.Environment
+	Filter      *secret.Filter
+}
+
+// An Explanation of how a secret in the source is handled.
+type Explanation struct {
+	Name              string          `json:"name"`
+	EnvFromName       string          `json:"env_from_name,omitempty"`
+	EnvFromTags       string          `json:"env_from_tags,omitempty"`
+	Environment       string          `json:"environment,omitempty"`
+	EnvironmentSource string          `json:"environment_source"`
+	Production        bool            `json:"production"`
+	BelongsTo         map[string]bool `json:"belongs_to"`
+	Targets           []*Decision     `json:"targets"`
+}
+
+// A Decision whether a secret is synced to a target.
+type Decision struct {
+	Job             string   `json:"job"`
+	Environment     string   `json:"environment"`
+	BelongsToEnv    bool     `json:"belongs_to_env"`
+	DestinationName string   `json:"destination_name"`
+	MatchesFilter   bool     `json:"matches_filter"`
+	Blocked         bool     `json:"blocked"`
+	Collisions      []string `json:"collisions,omitempty"`
+	Included        bool     `json:"included"`
+	Reason          string   `json:"reason"`
+}
+
+// Explain returns the explanation of how s is handled for each target. Collisions are the other
+// secrets in all with the same destination name in the target environment.
+func Explain(s *secret.Secret, all []*secret.Secret, targets []*Target) *Explanation {
+	e := &Explanation{
+		Name:              s.Name,
+		EnvironmentSource: SourceNone,
+		Production:        s.IsProduction(),
+		BelongsTo:         make(map[string]bool),
+	}
+
+	if env := s.GetEnvFromName(); env != nil {
+		e.EnvFromName = env.Name
+	}
+	if env := s.GetEnvFromTags(); env != nil {
+		e.EnvFromTags = env.Name
+	}
+
+	// GetEnv prefers the name over the tags
+	if e.EnvFromName != "" {
+		e.Environment, e.EnvironmentSource = e.EnvFromName, SourceName
+	} else if e.EnvFromTags != "" {
+		e.Environment, e.EnvironmentSource = e.EnvFromTags, SourceTags
+	}
+
+	for _, env := range secret.Environments {
+		e.BelongsTo[env.Name] = s.BelongsToEnv(env)
+	}
+
+	for _, target := range targets {
+		e.Targets = append(e.Targets, decide(s, all, target))
+	}
+
+	return e
+}
+
+// Find returns the secrets in all called name, either as named in the system or as named in the
+// destination, without the environment suffix.
+func Find(all []*secret.Secret, name string) []*secret.Secret {
+	var found []*secret.Secret
+
+	for _, s := range all {
+		if s.Name == name || s.DestinationName(&secret.DevEnv) == name {
+			found = append(found, s)
+		}
+	}
+
+	return found
+}
+
+// WriteText writes e to w in human-readable form.
+func (e *Explanation) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Secret %s\n", e.Name)
+	fmt.Fprintf(w, "  Environment from name:  %s\n", orNone(e.EnvFromName))
+	fmt.Fprintf(w, "  Environment from tags:  %s\n", orNone(e.EnvFromTags))
+	fmt.Fprintf(w, "  Environment:            %s (from %s)\n", orNone(e.Environment), e.EnvironmentSource)
+	fmt.Fprintf(w, "  Production:             %t\n", e.Production)
+
+	var belongs []string
+	for _, env := range secret.Environments {
+		if e.BelongsTo[env.Name] {
+			belongs = append(belongs, env.Name)
+		}
+	}
+	fmt.Fprintf(w, "  Belongs to:             %s\n", orNone(strings.Join(belongs, ", ")))
+
+	for _, d := range e.Targets {
+		result := "excluded"
+		if d.Included {
+			result = "included"
+		}
+
+		fmt.Fprintf(w, "\n  Job %s (%s): %s, %s\n", d.Job, d.Environment, result, d.Reason)
+		fmt.Fprintf(w, "    Belongs to environment: %t\n", d.BelongsToEnv)
+		fmt.Fprintf(w, "    Destination name:       %s\n", d.DestinationName)
+		fmt.Fprintf(w, "    Matches filter:         %t\n", d.MatchesFilter)
+		fmt.Fprintf(w, "    Blocked as production:  %t\n", d.Blocked)
+		fmt.Fprintf(w, "    Collisions:             %s\n", orNone(strings.Join(d.Collisions, ", ")))
+	}
+}
+
+// decide returns the decision whether s is synced to target.
+func decide(s *secret.Secret, all []*secret.Secret, target *Target) *Decision {
+	d := &Decision{
+		Job:             target.Job,
+		Environment:     target.Environment.Name,
+		BelongsToEnv:    s.BelongsToEnv(target.Environment),
+		DestinationName: s.DestinationName(target.Environment),
+		Blocked:         !target.Environment.Production && s.IsProduction(),
+	}
+
+	trimmed := *s
+	trimmed.Name = d.DestinationName
+	d.MatchesFilter = target.Filter.Matches(&trimmed)
+
+	for _, o := range all {
+		if o != s && o.BelongsToEnv(target.Environment) &&
+			o.DestinationName(target.Environment) == d.DestinationName {
+			d.Collisions = append(d.Collisions, o.Name)
+		}
+	}
+
+	switch {
+	case s.Environment == nil:
+		d.Reason = "no environment in name suffix or Environment tag"
+	case !d.BelongsToEnv:
+		d.Reason = fmt.Sprintf("environment %s does not belong to %s", s.Environment.Name, target.Environment.Name)
+	case !d.MatchesFilter:
+		d.Reason = "does not match the filters of the job"
+	case d.Blocked:
+		d.Reason = fmt.Sprintf("production secret blocked from %s", target.Environment.Name)
+	case len(d.Collisions) > 0:
+		d.Included = true
+		d.Reason = "synced, but other secrets have the same destination name"
+	default:
+		d.Included = true
+		d.Reason = "synced"
+	}
+
+	return d
+}
+
+// orNone returns str, or "none" if it's empty.
+func orNone(str string) string {
+	if str == "" {
+		return SourceNone
+	}
+
+	return str
+}
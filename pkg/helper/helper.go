@@ -1,44 +1,241 @@
 package helper
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// DeepEqual returns a boolean indicating whether the given maps m1 and m2 are equal. First checks
-// result according to reflect.DeepEqual(). If not equal, type unification is done by marshalling
-// and unmarshalling values, before running same reflect.DeepEqual again. If still not equal,
-// returns false.
-func DeepEqual(m1, m2 map[string]interface{}) bool {
-	if reflect.DeepEqual(m1, m2) {
-		return true
+const (
+	// HMACPrefix prefixes hashes returned by HMAC
+	HMACPrefix = "hmac-sha256:"
+)
+
+// Globs are compiled glob patterns, see CompileGlob.
+type Globs []*regexp.Regexp
+
+var (
+	settingsLock sync.RWMutex
+	settings     = make(map[string]map[string]string) // Settings by prefix, see SetSettings
+)
+
+// CompileGlob returns a regular expression matching the names which match the glob pattern. In the
+// pattern, "*" matches any sequence of characters except "/", "**" matches any sequence including
+// "/", and "?" matches any single character except "/".
+func CompileGlob(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				expr.WriteString(".*")
+				i++
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
 	}
 
-	var x1, x2 interface{}
-	bytes1, _ := json.Marshal(m1)
-	json.Unmarshal(bytes1, &x1)
+	expr.WriteString("$")
 
-	bytes2, _ := json.Marshal(m2)
-	json.Unmarshal(bytes2, &x2)
+	return regexp.MustCompile(expr.String())
+}
 
-	if reflect.DeepEqual(x1, x2) {
-		return true
+// CompileGlobs returns patterns compiled with CompileGlob.
+func CompileGlobs(patterns []string) Globs {
+	globs := make(Globs, 0, len(patterns))
+	for _, pattern := range patterns {
+		globs = append(globs, CompileGlob(pattern))
+	}
+
+	return globs
+}
+
+// Contains returns a boolean indicating whether values contain value.
+func Contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
 	}
 
 	return false
 }
 
+// DecodeJSON unmarshals the JSON document in data into v, like json.Unmarshal, but numbers are
+// decoded as json.Number instead of float64. This keeps their exact textual representation, so
+// e.g. large integers do not lose precision.
+func DecodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("invalid character after top-level value")
+	}
+
+	return nil
+}
+
+// DeepEqual returns a boolean indicating whether the given maps m1 and m2 are equal. Comparison is
+// exact and type-aware: numbers are compared by their exact value, and a number never equals a
+// string. See Equal.
+func DeepEqual(m1, m2 map[string]interface{}) bool {
+	if len(m1) != len(m2) {
+		return false
+	}
+
+	for key, v1 := range m1 {
+		v2, ok := m2[key]
+		if !ok || !Equal(v1, v2) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Equal returns a boolean indicating whether v1 and v2 are equal. Maps and slices are compared
+// recursively. Numbers, whether json.Number or any Go numeric type, are compared by their string
+// form, so 1 and 1.0 are not equal, and integers too large for float64 are compared digit by digit.
+// Any other types are compared with reflect.DeepEqual.
+func Equal(v1, v2 interface{}) bool {
+	if n1, ok := toNumber(v1); ok {
+		n2, ok := toNumber(v2)
+		return ok && n1 == n2
+	}
+
+	switch t1 := v1.(type) {
+	case map[string]interface{}:
+		t2, ok := v2.(map[string]interface{})
+		return ok && DeepEqual(t1, t2)
+
+	case []interface{}:
+		t2, ok := v2.([]interface{})
+		if !ok || len(t1) != len(t2) {
+			return false
+		}
+		for i := range t1 {
+			if !Equal(t1[i], t2[i]) {
+				return false
+			}
+		}
+		return true
+
+	default:
+		return reflect.DeepEqual(v1, v2)
+	}
+}
+
 // Getenv works similarly to os.Getenv, but with an extra prefix in the key. If the env variable has
-// a value with the prefix, that value is returned. If not, the value of env variable without it
-// will be returned.
+// a value with the prefix, that value is returned. If not, the value of env variable without the
+// prefix is returned, then the setting for the prefix, and finally the setting without a prefix. Env
+// variables thus always override settings. See SetSettings.
 func Getenv(prefix, key string) string {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+
 	if v := os.Getenv(prefix + key); v != "" {
 		return v
+	} else if v := os.Getenv(key); v != "" {
+		return v
+	} else if v := settings[prefix][key]; prefix != "" && v != "" {
+		return v
+	} else {
+		return settings[""][key]
+	}
+}
+
+// Hash returns a SHA-256 hash of data in format "sha256:<hex>". Data is hashed as JSON, which has
+// map keys sorted, so equal data always results in the same hash.
+func Hash(data interface{}) string {
+	bytes, _ := json.Marshal(data)
+	sum := sha256.Sum256(bytes)
+
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// HMAC returns an HMAC-SHA256 of data with key in format "hmac-sha256:<hex>". Data is encoded as
+// in Hash. Unlike Hash, it cannot be used to guess secret values without the key.
+func HMAC(key []byte, data interface{}) string {
+	bytes, _ := json.Marshal(data)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(bytes)
+
+	return HMACPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Match returns a boolean indicating whether name matches any of g.
+func (g Globs) Match(name string) bool {
+	for _, re := range g {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewID returns a new unique, chronologically sortable identifier, such as
+// "20231018T102030Z-1a2b3c4d".
+func NewID() string {
+	random := make([]byte, 4)
+	rand.Read(random)
+
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(random)
+}
+
+// toNumber returns v as a json.Number and true if v is a number, or false if it is not.
+func toNumber(v interface{}) (json.Number, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		return n, true
+	case float32:
+		return json.Number(strconv.FormatFloat(float64(n), 'g', -1, 32)), true
+	case float64:
+		return json.Number(strconv.FormatFloat(n, 'g', -1, 64)), true
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return json.Number(fmt.Sprintf("%d", n)), true
+	default:
+		return "", false
+	}
+}
+
+// SetSettings sets the values Getenv returns for keys with prefix, when not defined in env variables.
+// Keys are names of env variables without the prefix. Settings without a prefix are used for any
+// prefix. Nil settings remove those of prefix.
+func SetSettings(prefix string, values map[string]string) {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+
+	if values == nil {
+		delete(settings, prefix)
 	} else {
-		return os.Getenv(key)
+		settings[prefix] = values
 	}
 }
 
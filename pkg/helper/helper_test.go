@@ -0,0 +1,103 @@
+package helper
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEqualNumbers(t *testing.T) {
+	tests := []struct {
+		name   string
+		v1, v2 interface{}
+		equal  bool
+	}{
+		{"same integer", json.Number("1"), json.Number("1"), true},
+		{"integer and decimal", json.Number("1"), json.Number("1.0"), false},
+		{"integer and exponent", json.Number("100"), json.Number("1e2"), false},
+		{"trailing zero", json.Number("0.5"), json.Number("0.50"), false},
+		{"different integers", json.Number("1"), json.Number("2"), false},
+		{"beyond float64", json.Number("12345678901234567890"), json.Number("12345678901234567891"), false},
+		{"large equal", json.Number("12345678901234567890"), json.Number("12345678901234567890"), true},
+		{"decimal beyond float64", json.Number("0.1"), json.Number("0.10000000000000000001"), false},
+		{"json.Number and int", json.Number("42"), 42, true},
+		{"json.Number and float64", json.Number("0.5"), 0.5, true},
+		{"int and float64", 3, 3.0, true},
+		{"uint and int64", uint(7), int64(7), true},
+		{"number and string", json.Number("1"), "1", false},
+		{"string and number", "1", json.Number("1"), false},
+		{"number and nil", json.Number("0"), nil, false},
+		{"same exponent", json.Number("1e100000"), json.Number("1e100000"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Equal(tt.v1, tt.v2); got != tt.equal {
+				t.Errorf("Equal(%v, %v) = %t, want %t", tt.v1, tt.v2, got, tt.equal)
+			}
+		})
+	}
+}
+
+func TestDeepEqualNested(t *testing.T) {
+	m1 := map[string]interface{}{
+		"port":  json.Number("5432"),
+		"ratio": json.Number("0.5"),
+		"hosts": []interface{}{"a", json.Number("1")},
+		"db":    map[string]interface{}{"pool": json.Number("10")},
+	}
+	m2 := map[string]interface{}{
+		"port":  json.Number("5432"),
+		"ratio": json.Number("0.5"),
+		"hosts": []interface{}{"a", json.Number("1")},
+		"db":    map[string]interface{}{"pool": json.Number("10")},
+	}
+
+	if !DeepEqual(m1, m2) {
+		t.Errorf("DeepEqual(%v, %v) = false, want true", m1, m2)
+	}
+
+	m2["hosts"] = []interface{}{"a", json.Number("1.0")}
+	if DeepEqual(m1, m2) {
+		t.Errorf("DeepEqual(%v, %v) = true, want false", m1, m2)
+	}
+
+	m2["hosts"] = m1["hosts"]
+	m2["db"] = map[string]interface{}{"pool": "10"}
+	if DeepEqual(m1, m2) {
+		t.Errorf("DeepEqual(%v, %v) = true, want false", m1, m2)
+	}
+}
+
+func TestGetenv(t *testing.T) {
+	SetSettings("", map[string]string{"TEST_ADDR": "top-level"})
+	SetSettings("DEST_", map[string]string{"TEST_ADDR": "dest"})
+	t.Cleanup(func() {
+		SetSettings("", nil)
+		SetSettings("DEST_", nil)
+	})
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"setting of prefix", nil, "dest"},
+		{"env variable", map[string]string{"TEST_ADDR": "env"}, "env"},
+		{"prefixed env variable", map[string]string{"TEST_ADDR": "env", "DEST_TEST_ADDR": "dest-env"}, "dest-env"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, val := range tt.env {
+				t.Setenv(key, val)
+			}
+			if got := Getenv("DEST_", "TEST_ADDR"); got != tt.want {
+				t.Errorf("Getenv() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := Getenv("SOURCE_", "TEST_ADDR"); got != "top-level" {
+		t.Errorf("Getenv() without setting of prefix = %q, want %q", got, "top-level")
+	}
+}
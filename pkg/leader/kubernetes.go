@@ -0,0 +1,216 @@
+package leader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// serviceAccountDir has the credentials and namespace of the pod's service account
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+
+	leasesPath      = "/apis/coordination.k8s.io/v1/namespaces/%s/leases"
+	microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+	requestTimeout  = 10 * time.Second
+)
+
+// A kubernetesLock is a Lease called name in namespace, accessed with the service account of the
+// pod.
+type kubernetesLock struct {
+	client    *http.Client
+	host      string
+	name      string
+	namespace string
+}
+
+// A lease as in the coordination.k8s.io/v1 API.
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+// The leaseMetadata of a lease. ResourceVersion guards updates against concurrent changes.
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// The leaseSpec of a lease. Times are in microTimeFormat.
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// newKubernetesLock returns the Lease called name in namespace, or in the namespace of the pod if
+// empty, on the API server of the cluster the pod runs in.
+func newKubernetesLock(name, namespace string) (*kubernetesLock, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in Kubernetes, KUBERNETES_SERVICE_HOST not defined")
+	}
+
+	if namespace == "" {
+		content, err := os.ReadFile(serviceAccountDir + "namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(content))
+	}
+
+	ca, err := os.ReadFile(serviceAccountDir + "ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", serviceAccountDir+"ca.crt")
+	}
+
+	return &kubernetesLock{
+		client: &http.Client{
+			Timeout:   requestTimeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		host:      "https://" + net.JoinHostPort(host, port),
+		name:      name,
+		namespace: namespace,
+	}, nil
+}
+
+// Acquire acquires the Lease for holder until ttl from now, or renews it if holder already has it.
+// The Lease is created if it does not exist. Updates are guarded by the resource version read, so of
+// concurrent attempts only one succeeds.
+func (k *kubernetesLock) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	seconds := int(math.Ceil(ttl.Seconds()))
+
+	var l lease
+	status, err := k.do(ctx, http.MethodGet, k.name, nil, &l)
+	if err != nil {
+		return false, err
+	}
+
+	if status == http.StatusNotFound {
+		l = lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   leaseMetadata{Name: k.name, Namespace: k.namespace},
+			Spec: leaseSpec{
+				HolderIdentity:       holder,
+				LeaseDurationSeconds: seconds,
+				AcquireTime:          now.Format(microTimeFormat),
+				RenewTime:            now.Format(microTimeFormat),
+			},
+		}
+
+		status, err := k.do(ctx, http.MethodPost, "", &l, nil)
+		return err == nil && status != http.StatusConflict, err
+	}
+
+	if current := l.Spec.HolderIdentity; current != "" && current != holder {
+		renewed, _ := time.Parse(microTimeFormat, l.Spec.RenewTime)
+		expires := renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second)
+		if now.Before(expires) {
+			return false, nil
+		}
+	}
+
+	if l.Spec.HolderIdentity != holder {
+		l.Spec.HolderIdentity = holder
+		l.Spec.AcquireTime = now.Format(microTimeFormat)
+		l.Spec.LeaseTransitions++
+	}
+	l.Spec.LeaseDurationSeconds = seconds
+	l.Spec.RenewTime = now.Format(microTimeFormat)
+
+	status, err = k.do(ctx, http.MethodPut, k.name, &l, nil)
+	return err == nil && status != http.StatusConflict, err
+}
+
+// Release releases the Lease, if holder has it, by clearing its holder.
+func (k *kubernetesLock) Release(ctx context.Context, holder string) error {
+	var l lease
+	status, err := k.do(ctx, http.MethodGet, k.name, nil, &l)
+	if err != nil || status == http.StatusNotFound || l.Spec.HolderIdentity != holder {
+		return err
+	}
+
+	l.Spec.HolderIdentity = ""
+	l.Spec.LeaseDurationSeconds = 1
+	l.Spec.RenewTime = time.Now().UTC().Format(microTimeFormat)
+
+	// On conflict, it has been taken over in between, so it's no longer ours to release
+	_, err = k.do(ctx, http.MethodPut, k.name, &l, nil)
+
+	return err
+}
+
+// do sends a request bound to ctx with method to the Lease called name, or to the leases of k.namespace if name
+// is empty, with body encoded as JSON, if not nil. The response is decoded into out, if not nil.
+// Returns the status of the response. Not found and conflict are not errors, other failed
+// responses are.
+func (k *kubernetesLock) do(ctx context.Context, method, name string, body, out interface{}) (int, error) {
+	url := k.host + fmt.Sprintf(leasesPath, k.namespace)
+	if name != "" {
+		url += "/" + name
+	}
+
+	var content []byte
+	if body != nil {
+		var err error
+		if content, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(content))
+	if err != nil {
+		return 0, err
+	}
+
+	// The token is read for each request, as projected tokens are rotated
+	token, err := os.ReadFile(serviceAccountDir + "token")
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusConflict:
+		return resp.StatusCode, nil
+	case resp.StatusCode >= 300:
+		return resp.StatusCode, fmt.Errorf("unexpected response %s from %s", resp.Status, url)
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+
+	return resp.StatusCode, nil
+}
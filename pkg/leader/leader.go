@@ -0,0 +1,235 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync-secrets/pkg/helper"
+	"sync-secrets/pkg/vault"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EnvElection      = "LEADER_ELECTION"
+	EnvIdentity      = "LEADER_IDENTITY"
+	EnvLeaseDuration = "LEADER_LEASE_DURATION"
+	EnvLeaseName     = "LEADER_LEASE_NAME"
+	EnvNamespace     = "LEADER_NAMESPACE"
+
+	// PrefixVault is the prefix of the settings of the Vault holding the lock, such as
+	// LEADER_VAULT_ADDR. Unprefixed settings are used if not defined.
+	PrefixVault = "LEADER_"
+
+	ElectionKubernetes = "kubernetes" // Kubernetes Lease
+	ElectionVault      = "vault"      // Lock entry in Vault
+
+	DefaultLeaseDuration = 15 * time.Second
+	DefaultLeaseName     = "secret-sync"
+)
+
+// A Lock held by a single holder at a time, until it's released or expires.
+type Lock interface {
+	// Acquire acquires the lock for holder until ttl from now, or renews it if holder already has
+	// it. Returns false if another holder has the lock.
+	Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error)
+
+	// Release releases the lock, if holder has it.
+	Release(ctx context.Context, holder string) error
+}
+
+// An Elector elects a single leader among replicas by acquiring Lock for Identity. The leader
+// renews the lock every third of LeaseDuration. Others take over once it expires, or as soon as it
+// is released.
+type Elector struct {
+	Lock          Lock
+	Identity      string
+	LeaseDuration time.Duration
+
+	mu       sync.Mutex // Held while renewing or releasing, so that released locks are not renewed
+	released bool
+	expiry   *time.Timer // Fires when leadership may have been lost, see renew
+}
+
+// New returns a new Elector with the Lock in LEADER_ELECTION env variable, or nil if not defined.
+func New() *Elector {
+	election := helper.Getenv("", EnvElection)
+	if election == "" {
+		return nil
+	}
+
+	e := Elector{LeaseDuration: DefaultLeaseDuration}
+
+	if v := helper.Getenv("", EnvLeaseDuration); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 3*time.Second {
+			log.Fatalf("%s should be a duration of at least 3s, such as 15s: %s", EnvLeaseDuration, v)
+		}
+		e.LeaseDuration = d
+	}
+
+	name := helper.Getenv("", EnvLeaseName)
+	if name == "" {
+		name = DefaultLeaseName
+	}
+
+	if v := helper.Getenv("", EnvIdentity); v != "" {
+		e.Identity = v
+	} else {
+		// The host name is the name of the pod in Kubernetes
+		host, _ := os.Hostname()
+		e.Identity = fmt.Sprintf("%s-%s", host, helper.NewID())
+	}
+
+	switch election {
+	case ElectionKubernetes:
+		lock, err := newKubernetesLock(name, helper.Getenv("", EnvNamespace))
+		if err != nil {
+			log.WithError(err).Fatal("Unable to configure Kubernetes Lease")
+		}
+		e.Lock = lock
+
+	case ElectionVault:
+		e.Lock = &vaultLock{vault: vault.New(PrefixVault), name: name}
+
+	default:
+		log.Fatalf("%s should be one of: %s, %s", EnvElection, ElectionKubernetes, ElectionVault)
+	}
+
+	return &e
+}
+
+// Acquire waits until e is the leader, then keeps renewing the lock in the background until
+// Release. If the lock is not renewed in time, another replica may take over, so the process exits.
+func (e *Elector) Acquire() {
+	fields := log.Fields{"identity": e.Identity}
+
+	for waiting := false; ; waiting = true {
+		start := time.Now()
+		ok, err := e.acquire()
+		if err != nil {
+			log.WithFields(fields).WithError(err).Error("Unable to acquire leadership")
+		} else if ok {
+			e.mu.Lock()
+			e.expiry = time.AfterFunc(time.Until(e.deadline(start)), e.lost)
+			e.mu.Unlock()
+			break
+		} else if !waiting {
+			log.WithFields(fields).Info("Waiting for leadership")
+		}
+
+		time.Sleep(e.LeaseDuration / 3)
+	}
+
+	log.WithFields(fields).Info("Acquired leadership")
+
+	go e.renew()
+}
+
+// Release stops renewing the lock and releases it, so that another replica takes over without
+// waiting for it to expire.
+func (e *Elector) Release() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.released {
+		return
+	}
+	e.released = true
+	if e.expiry != nil {
+		e.expiry.Stop()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout())
+	defer cancel()
+
+	fields := log.Fields{"identity": e.Identity}
+	if err := e.Lock.Release(ctx, e.Identity); err != nil {
+		log.WithFields(fields).WithError(err).Error("Unable to release leadership")
+		return
+	}
+
+	log.WithFields(fields).Info("Released leadership")
+}
+
+// acquire acquires or renews the lock, within e.timeout.
+func (e *Elector) acquire() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout())
+	defer cancel()
+
+	return e.Lock.Acquire(ctx, e.Identity, e.LeaseDuration)
+}
+
+// deadline returns when leadership acquired or renewed at start must be given up: a third of
+// e.LeaseDuration before the lock expires, leaving time to stop before another replica may take
+// over.
+func (e *Elector) deadline(start time.Time) time.Time {
+	return start.Add(e.LeaseDuration - e.LeaseDuration/3)
+}
+
+// lost exits the process, as leadership may have been lost, unless e has been released.
+func (e *Elector) lost() {
+	e.mu.Lock()
+	released := e.released
+	e.mu.Unlock()
+
+	// mu is not held when exiting, as exit handlers release the lock
+	if !released {
+		log.WithFields(log.Fields{"identity": e.Identity}).
+			Fatal("Leadership lost, lock not renewed in time")
+	}
+}
+
+// renew renews the lock every third of e.LeaseDuration until e is released. Each renewal extends
+// the deadline of e.expiry, measured from when the renewal started, so leadership is given up in
+// time even if a renewal hangs. Exits if the lock is taken by another replica.
+func (e *Elector) renew() {
+	fields := log.Fields{"identity": e.Identity}
+
+	for {
+		time.Sleep(e.LeaseDuration / 3)
+
+		e.mu.Lock()
+		if e.released {
+			e.mu.Unlock()
+			return
+		}
+		start := time.Now()
+		ok, err := e.acquire()
+		if err == nil && ok && time.Now().Before(e.deadline(start)) {
+			e.expiry.Reset(time.Until(e.deadline(start)))
+		}
+		e.mu.Unlock()
+
+		switch {
+		case err != nil:
+			log.WithFields(fields).WithError(err).Warn("Unable to renew leadership, retrying")
+		case !ok:
+			log.WithFields(fields).Fatal("Leadership lost to another replica")
+		}
+	}
+}
+
+// timeout returns the timeout of requests to e.Lock: short enough that a failed renewal can be
+// retried before the deadline.
+func (e *Elector) timeout() time.Duration {
+	return e.LeaseDuration / 6
+}
+
+// A vaultLock is a lock entry called name in Vault.
+type vaultLock struct {
+	vault *vault.Vault
+	name  string
+}
+
+// Acquire acquires the lock entry for holder, see vault.AcquireLock.
+func (l *vaultLock) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	return l.vault.AcquireLock(ctx, l.name, holder, ttl)
+}
+
+// Release releases the lock entry, if holder has it.
+func (l *vaultLock) Release(ctx context.Context, holder string) error {
+	return l.vault.ReleaseLock(ctx, l.name, holder)
+}
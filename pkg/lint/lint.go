@@ -0,0 +1,151 @@
+package lint
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync-secrets/pkg/secret"
+	"sync-secrets/pkg/tags"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+
+	CheckCollision  = "collision"    // Secrets with the same destination name in an environment
+	CheckLimits     = "limits"       // Tags exceed the limits of the destination
+	CheckMismatch   = "env-mismatch" // Environments in name suffix and Environment tag differ
+	CheckNoEnv      = "no-env"       // No environment, so the secret is never synced
+	CheckUnknownEnv = "unknown-env"  // Environment tag is not a known environment
+)
+
+// A Finding about a secret in the source. For collisions, Name is the destination name the
+// colliding secrets are synced to.
+type Finding struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	Name     string `json:"name"`
+	Message  string `json:"message"`
+}
+
+// A collision of secrets synced to the same name in envs.
+type collision struct {
+	name    string
+	secrets []string
+	envs    []string
+}
+
+// Lint returns the findings about secrets, sorted by name. Tags are checked against limits after
+// mapping them with rules; nil limits or rules are not checked or applied.
+func Lint(secrets []*secret.Secret, limits *tags.Limits, rules *tags.Rules) []*Finding {
+	var findings []*Finding
+	add := func(severity, check string, s *secret.Secret, format string, a ...interface{}) {
+		findings = append(findings, &Finding{
+			Severity: severity,
+			Check:    check,
+			Name:     s.Name,
+			Message:  fmt.Sprintf(format, a...),
+		})
+	}
+
+	for _, s := range secrets {
+		fromName, fromTags := s.GetEnvFromName(), s.GetEnvFromTags()
+
+		if tag := s.GetTagValue("Environment"); tag != "" && fromTags == nil {
+			add(SeverityError, CheckUnknownEnv, s, "Environment tag %s is not a known environment", tag)
+		}
+
+		if fromName != nil && fromTags != nil && *fromName != *fromTags {
+			add(SeverityError, CheckMismatch, s, "name suffix is %s but Environment tag is %s, %s is used",
+				fromName.Name, fromTags.Name, fromName.Name)
+		}
+
+		if fromName == nil && fromTags == nil && s.Environment == nil {
+			add(SeverityWarning, CheckNoEnv, s, "no environment in name suffix or Environment tag, never synced")
+		}
+
+		if limits != nil {
+			mapped := s.Tags
+			if rules != nil {
+				var err error
+				if mapped, err = rules.Map(s.Tags); err != nil {
+					add(SeverityError, CheckLimits, s, "%s", err)
+					continue
+				}
+			}
+
+			if err := limits.Validate(mapped); err != nil {
+				add(SeverityError, CheckLimits, s, "%s", err)
+			}
+		}
+	}
+
+	// Secrets colliding in several environments are reported once, with all the environments
+	var groups []*collision
+	for _, env := range secret.Environments {
+		if env.IsGroup {
+			continue
+		}
+
+		byName := make(map[string][]string)
+		for _, s := range secrets {
+			if s.BelongsToEnv(env) {
+				name := s.DestinationName(env)
+				byName[name] = append(byName[name], s.Name)
+			}
+		}
+
+		for name, colliding := range byName {
+			if len(colliding) < 2 {
+				continue
+			}
+			sort.Strings(colliding)
+			groups = addCollision(groups, name, colliding, env.Name)
+		}
+	}
+
+	for _, c := range groups {
+		findings = append(findings, &Finding{
+			Severity: SeverityError,
+			Check:    CheckCollision,
+			Name:     c.name,
+			Message: fmt.Sprintf("%s are synced to it in %s", strings.Join(c.secrets, ", "),
+				strings.Join(c.envs, ", ")),
+		})
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Name != findings[j].Name {
+			return findings[i].Name < findings[j].Name
+		}
+		return findings[i].Message < findings[j].Message
+	})
+
+	return findings
+}
+
+// Errors returns the number of findings with error severity.
+func Errors(findings []*Finding) int {
+	var errors int
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			errors++
+		}
+	}
+
+	return errors
+}
+
+// addCollision adds env to the collision of secrets synced to name in groups, or adds such a
+// collision if there is none. Returns groups.
+func addCollision(groups []*collision, name string, secrets []string, env string) []*collision {
+	key := strings.Join(secrets, "\x00")
+	for _, c := range groups {
+		if c.name == name && strings.Join(c.secrets, "\x00") == key {
+			c.envs = append(c.envs, env)
+			return groups
+		}
+	}
+
+	return append(groups, &collision{name: name, secrets: secrets, envs: []string{env}})
+}
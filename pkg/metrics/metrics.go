@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	EnvFile = "METRICS_FILE"
+
+	TypeCounter = "counter"
+	TypeGauge   = "gauge"
+)
+
+var (
+	lock     sync.Mutex
+	registry = make(map[string]*metric)
+)
+
+// A metric with its samples, keyed by their rendered labels.
+type metric struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples map[string]float64
+}
+
+// Add adds value to the counter name with labels. The counter is created if it does not exist.
+func Add(name, help string, labels map[string]string, value float64) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	get(name, help, TypeCounter).Samples[formatLabels(labels)] += value
+}
+
+// Set sets the gauge name with labels to value. The gauge is created if it does not exist.
+func Set(name, help string, labels map[string]string, value float64) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	get(name, help, TypeGauge).Samples[formatLabels(labels)] = value
+}
+
+// Write writes all metrics to the file in path, in Prometheus text format. This format is
+// understood e.g. by the textfile collector of Prometheus node exporter. The file is replaced
+// atomically, so a collector never reads a partially written file.
+func Write(path string) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		m := registry[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n", m.Name, m.Help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", m.Name, m.Type)
+
+		var labels []string
+		for l := range m.Samples {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+
+		for _, l := range labels {
+			fmt.Fprintf(&b, "%s%s %g\n", m.Name, l, m.Samples[l])
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// formatLabels returns labels in Prometheus format, e.g. `{path="a/b",system="vault"}`.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var pairs []string
+	for key, val := range labels {
+		val = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(val)
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, key, val))
+	}
+	sort.Strings(pairs)
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// get returns the metric with name, creating it if it does not exist. Must be called with lock held.
+func get(name, help, metricType string) *metric {
+	if m, ok := registry[name]; ok {
+		return m
+	}
+
+	m := metric{Name: name, Help: help, Type: metricType, Samples: make(map[string]float64)}
+	registry[name] = &m
+
+	return &m
+}
@@ -0,0 +1,347 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync-secrets/pkg/helper"
+	"sync-secrets/pkg/redact"
+	"sync-secrets/pkg/report"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EnvWebhooksFile = "WEBHOOKS_FILE"
+
+	EventSyncCompleted = "sync-completed" // Job completed without failed secrets
+	EventSyncFailed    = "sync-failed"    // Job completed with failed secrets, or aborted
+
+	FormatGeneric = "generic"
+	FormatSlack   = "slack"
+	FormatTeams   = "teams"
+
+	ModeRun    = "run"    // One notification per job
+	ModeSecret = "secret" // One notification per changed secret
+
+	// HeaderSignature has the HMAC-SHA256 signature of the body, as "sha256=<hex>"
+	HeaderSignature = "X-Secret-Sync-Signature"
+
+	defaultRetries = 3
+	defaultTimeout = 10 * time.Second
+)
+
+var (
+	// RetryDelay is the delay before the first retry of a failed notification, doubled for each
+	// retry.
+	RetryDelay = time.Second
+
+	// SendTimeout bounds the time spent sending a notification, including all its retries, so that
+	// an unavailable webhook holds up a sync for a limited time only.
+	SendTimeout = 30 * time.Second
+)
+
+// A Webhook notified of sync jobs, in Format. A job notifies a webhook if its environment is one of
+// Environments (or Environments is empty). Each secret changed in the job is included if its name
+// matches any of Paths and its action is one of Events. Empty Paths and Events match any changed
+// secret. A run notification is sent if any secret was included, or if the event of the run is one
+// of Events. Without Events, a failed run is always notified, also in ModeSecret.
+type Webhook struct {
+	Name         string   `json:"name"`
+	URL          string   `json:"url"`
+	Format       string   `json:"format,omitempty"`
+	Mode         string   `json:"mode,omitempty"`
+	Environments []string `json:"environments,omitempty"`
+	Paths        []string `json:"paths,omitempty"`
+	Events       []string `json:"events,omitempty"`
+	SecretEnv    string   `json:"secret_env,omitempty"` // Env variable with the HMAC signing key
+	Retries      *int     `json:"retries,omitempty"`
+
+	paths helper.Globs // Paths compiled on first use, see matches
+}
+
+// A Notification of a job, sent as JSON in FormatGeneric. Secret values are never included.
+type Notification struct {
+	Event       string           `json:"event"`
+	Time        time.Time        `json:"time"`
+	Job         string           `json:"job"`
+	SyncID      string           `json:"sync_id"`
+	Environment string           `json:"environment"`
+	Source      *report.System   `json:"source,omitempty"`
+	Destination *report.System   `json:"destination,omitempty"`
+	Secrets     []*report.Secret `json:"secrets"`
+	Totals      map[string]int   `json:"totals,omitempty"`
+	Error       string           `json:"error,omitempty"`
+}
+
+// Load reads webhooks from the JSON file in path and validates them.
+func Load(path string) ([]*Webhook, error) {
+	var hooks []*Webhook
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := helper.DecodeJSON(content, &hooks); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i, h := range hooks {
+		if err := h.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: webhook %d (%s): %w", path, i, h.Name, err)
+		}
+	}
+
+	return hooks, nil
+}
+
+// Notify sends the notifications of job to each webhook in hooks. If err is not nil, the job was
+// aborted. Failures are logged, they never fail the sync.
+func Notify(hooks []*Webhook, job *report.Job, err error) {
+	for _, h := range hooks {
+		for _, n := range h.notifications(job, err) {
+			if err := h.Send(n); err != nil {
+				log.WithFields(log.Fields{
+					"event":   n.Event,
+					"webhook": h.Name,
+				}).WithError(err).Error("Unable to send notification")
+			}
+		}
+	}
+}
+
+// Send sends n to h, retrying failed requests up to h.Retries times, for at most SendTimeout.
+func (h *Webhook) Send(n *Notification) error {
+	body, err := h.payload(n)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), SendTimeout)
+	defer cancel()
+
+	retries := defaultRetries
+	if h.Retries != nil {
+		retries = *h.Retries
+	}
+
+	delay := RetryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := h.post(ctx, body)
+		if err == nil {
+			log.WithFields(log.Fields{
+				"event":   n.Event,
+				"webhook": h.Name,
+			}).Info("Notification sent")
+			return nil
+		}
+
+		if !retry || attempt >= retries {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"attempt": attempt + 1,
+			"webhook": h.Name,
+		}).WithError(err).Warn("Notification failed, retrying")
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// Validate returns an error if h is not a valid webhook.
+func (h *Webhook) Validate() error {
+	if h.URL == "" {
+		return errors.New("url is required")
+	}
+
+	switch h.Format {
+	case "", FormatGeneric, FormatSlack, FormatTeams:
+	default:
+		return fmt.Errorf("format should be one of: %s, %s, %s", FormatGeneric, FormatSlack, FormatTeams)
+	}
+
+	switch h.Mode {
+	case "", ModeRun, ModeSecret:
+	default:
+		return fmt.Errorf("mode should be one of: %s, %s", ModeRun, ModeSecret)
+	}
+
+	if h.Retries != nil && *h.Retries < 0 {
+		return errors.New("retries should not be negative")
+	}
+
+	if h.SecretEnv != "" && helper.Getenv("", h.SecretEnv) == "" {
+		return fmt.Errorf("signing key in %s not defined", h.SecretEnv)
+	}
+
+	return nil
+}
+
+// matches returns a boolean indicating whether the change to s is included in notifications of h.
+func (h *Webhook) matches(s *report.Secret) bool {
+	if s.Action == report.ActionUnchanged {
+		return false
+	}
+
+	if len(h.Events) > 0 && !helper.Contains(h.Events, s.Action) {
+		return false
+	}
+
+	if h.paths == nil {
+		h.paths = helper.CompileGlobs(h.Paths)
+	}
+
+	return len(h.Paths) == 0 || h.paths.Match(s.Name)
+}
+
+// notifications returns the notifications of job to send to h. If err is not nil, the job was
+// aborted.
+func (h *Webhook) notifications(job *report.Job, err error) []*Notification {
+	if len(h.Environments) > 0 && !helper.Contains(h.Environments, job.Environment) {
+		return nil
+	}
+
+	event := EventSyncCompleted
+	if err != nil || job.Totals[report.ActionFailed] > 0 {
+		event = EventSyncFailed
+	}
+
+	var secrets []*report.Secret
+	for _, s := range job.Secrets {
+		if h.matches(s) {
+			secrets = append(secrets, s)
+		}
+	}
+
+	newNotification := func(event string, secrets []*report.Secret) *Notification {
+		n := &Notification{
+			Event:       event,
+			Time:        time.Now().UTC(),
+			Job:         job.Name,
+			SyncID:      job.SyncID,
+			Environment: job.Environment,
+			Source:      job.Source,
+			Destination: job.Destination,
+			Secrets:     secrets,
+		}
+		if err != nil {
+			n.Error = redact.String(err.Error())
+		}
+		return n
+	}
+
+	failed := event == EventSyncFailed && (len(h.Events) == 0 || helper.Contains(h.Events, event))
+
+	if h.Mode == ModeSecret {
+		var notifications []*Notification
+		for _, s := range secrets {
+			notifications = append(notifications, newNotification(s.Action, []*report.Secret{s}))
+		}
+
+		// A failure is notified for the run too, as an aborted job may have no changed secrets
+		if failed {
+			n := newNotification(event, []*report.Secret{})
+			n.Totals = job.Totals
+			notifications = append(notifications, n)
+		}
+
+		return notifications
+	}
+
+	if len(secrets) == 0 && !failed && !helper.Contains(h.Events, event) {
+		return nil
+	}
+
+	if secrets == nil {
+		secrets = []*report.Secret{}
+	}
+	n := newNotification(event, secrets)
+	n.Totals = job.Totals
+
+	return []*Notification{n}
+}
+
+// payload returns n encoded in the format of h.
+func (h *Webhook) payload(n *Notification) ([]byte, error) {
+	switch h.Format {
+	case FormatSlack:
+		return json.Marshal(map[string]string{"text": summary(n, "*", "• ")})
+	case FormatTeams:
+		return json.Marshal(map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  fmt.Sprintf("secret-sync %s: %s", n.Job, n.Event),
+			"text":     strings.ReplaceAll(summary(n, "**", "- "), "\n", "\n\n"),
+		})
+	default:
+		return json.Marshal(n)
+	}
+}
+
+// post posts body to h, signed if h has a signing key. Returns the error, if any, and a boolean
+// indicating whether the request may succeed if retried.
+func (h *Webhook) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if h.SecretEnv != "" {
+		mac := hmac.New(sha256.New, []byte(helper.Getenv("", h.SecretEnv)))
+		mac.Write(body)
+		req.Header.Set(HeaderSignature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := (&http.Client{Timeout: defaultTimeout}).Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+
+	return false, nil
+}
+
+// summary returns a human-readable summary of n, with bold text between strong and each secret on
+// its own line starting with bullet.
+func summary(n *Notification, strong, bullet string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%ssecret-sync %s%s (%s): %s", strong, n.Job, strong, n.Environment, n.Event)
+	if n.Error != "" {
+		fmt.Fprintf(&b, ", %s", n.Error)
+	}
+
+	for _, s := range n.Secrets {
+		fmt.Fprintf(&b, "\n%s%s: %s", bullet, s.Name, s.Action)
+		if s.Reason != "" {
+			fmt.Fprintf(&b, " (%s)", s.Reason)
+		}
+		if s.Error != "" {
+			fmt.Fprintf(&b, ": %s", s.Error)
+		}
+	}
+
+	return b.String()
+}
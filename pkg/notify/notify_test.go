@@ -0,0 +1,340 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync-secrets/pkg/redact"
+	"sync-secrets/pkg/report"
+	"testing"
+	"time"
+)
+
+// A request received by a webhook server.
+type request struct {
+	body      []byte
+	signature string
+}
+
+// webhookServer is an httptest.Server responding with statuses in order, and 200 when they run
+// out. Received requests are recorded.
+type webhookServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	requests []*request
+	statuses []int
+}
+
+func newWebhookServer(t *testing.T, statuses ...int) *webhookServer {
+	t.Helper()
+
+	s := &webhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		s.requests = append(s.requests, &request{body: body, signature: r.Header.Get(HeaderSignature)})
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *webhookServer) received() []*request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.requests
+}
+
+// noDelay removes the delay between retries for the duration of the test.
+func noDelay(t *testing.T) {
+	t.Helper()
+
+	delay := RetryDelay
+	RetryDelay = time.Millisecond
+	t.Cleanup(func() { RetryDelay = delay })
+}
+
+func testJob() *report.Job {
+	return &report.Job{
+		Name:        "apps",
+		SyncID:      "20231018T102030Z-1a2b3c4d",
+		Environment: "dev",
+		Secrets: []*report.Secret{
+			{Name: "apps/db", Action: report.ActionDataUpdated},
+			{Name: "apps/cache", Action: report.ActionUnchanged},
+			{Name: "other/api", Action: report.ActionCreated},
+		},
+		Totals: map[string]int{report.ActionDataUpdated: 1, report.ActionUnchanged: 1, report.ActionCreated: 1},
+	}
+}
+
+func TestPayloads(t *testing.T) {
+	n := &Notification{
+		Event:       EventSyncCompleted,
+		Job:         "apps",
+		SyncID:      "20231018T102030Z-1a2b3c4d",
+		Environment: "dev",
+		Secrets:     []*report.Secret{{Name: "apps/db", Action: report.ActionDataUpdated}},
+	}
+
+	t.Run("generic", func(t *testing.T) {
+		body, err := (&Webhook{}).payload(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got Notification
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatalf("payload is not a notification: %v", err)
+		}
+		if got.Event != n.Event || got.Job != n.Job || len(got.Secrets) != 1 || got.Secrets[0].Name != "apps/db" {
+			t.Errorf("payload = %s", body)
+		}
+	})
+
+	t.Run("slack", func(t *testing.T) {
+		body, err := (&Webhook{Format: FormatSlack}).payload(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got map[string]string
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatal(err)
+		}
+		want := "*secret-sync apps* (dev): sync-completed\n• apps/db: data-updated"
+		if len(got) != 1 || got["text"] != want {
+			t.Errorf("payload = %s, want text %q", body, want)
+		}
+	})
+
+	t.Run("teams", func(t *testing.T) {
+		body, err := (&Webhook{Format: FormatTeams}).payload(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got map[string]string
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatal(err)
+		}
+		want := "**secret-sync apps** (dev): sync-completed\n\n- apps/db: data-updated"
+		if got["@type"] != "MessageCard" || got["summary"] != "secret-sync apps: sync-completed" || got["text"] != want {
+			t.Errorf("payload = %s, want text %q", body, want)
+		}
+	})
+}
+
+func TestSendSignature(t *testing.T) {
+	t.Setenv("WEBHOOK_TEST_KEY", "signing-key")
+	server := newWebhookServer(t)
+	h := &Webhook{Name: "test", URL: server.URL, SecretEnv: "WEBHOOK_TEST_KEY"}
+
+	if err := h.Send(&Notification{Event: EventSyncCompleted, Job: "apps"}); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := server.received()
+	if len(requests) != 1 {
+		t.Fatalf("received %d requests, want 1", len(requests))
+	}
+
+	mac := hmac.New(sha256.New, []byte("signing-key"))
+	mac.Write(requests[0].body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); requests[0].signature != want {
+		t.Errorf("signature = %q, want %q", requests[0].signature, want)
+	}
+}
+
+func TestSendUnsigned(t *testing.T) {
+	server := newWebhookServer(t)
+	h := &Webhook{Name: "test", URL: server.URL}
+
+	if err := h.Send(&Notification{Event: EventSyncCompleted}); err != nil {
+		t.Fatal(err)
+	}
+	if requests := server.received(); len(requests) != 1 || requests[0].signature != "" {
+		t.Errorf("requests = %v, want a single unsigned one", requests)
+	}
+}
+
+func TestSendRetries(t *testing.T) {
+	noDelay(t)
+	retries := 2
+
+	tests := []struct {
+		name     string
+		statuses []int
+		requests int
+		fails    bool
+	}{
+		{"success", nil, 1, false},
+		{"server error retried", []int{500, 502}, 3, false},
+		{"too many requests retried", []int{429}, 2, false},
+		{"retries run out", []int{503, 503, 503, 503}, 3, true},
+		{"client error not retried", []int{400}, 1, true},
+		{"not found not retried", []int{404}, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newWebhookServer(t, tt.statuses...)
+			h := &Webhook{Name: "test", URL: server.URL, Retries: &retries}
+
+			err := h.Send(&Notification{Event: EventSyncCompleted})
+			if (err != nil) != tt.fails {
+				t.Errorf("Send() error = %v, want error %t", err, tt.fails)
+			}
+			if got := len(server.received()); got != tt.requests {
+				t.Errorf("received %d requests, want %d", got, tt.requests)
+			}
+		})
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	timeout := SendTimeout
+	SendTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { SendTimeout = timeout })
+
+	retries := 100
+	server := newWebhookServer(t, 500, 500, 500, 500, 500, 500, 500, 500, 500, 500)
+	h := &Webhook{Name: "test", URL: server.URL, Retries: &retries}
+
+	start := time.Now()
+	if err := h.Send(&Notification{Event: EventSyncCompleted}); err == nil {
+		t.Error("Send() succeeded, want error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Send() took %s, want at most about %s", elapsed, SendTimeout)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	tests := []struct {
+		name   string
+		hook   *Webhook
+		err    error
+		failed bool
+		want   []string // Event and names of secrets of each notification
+	}{
+		{
+			name: "run",
+			hook: &Webhook{},
+			want: []string{"sync-completed apps/db,other/api"},
+		},
+		{
+			name: "run with paths",
+			hook: &Webhook{Paths: []string{"apps/*"}},
+			want: []string{"sync-completed apps/db"},
+		},
+		{
+			name: "run with no matching secret",
+			hook: &Webhook{Paths: []string{"none/*"}},
+			want: nil,
+		},
+		{
+			name: "other environment",
+			hook: &Webhook{Environments: []string{"prod"}},
+			want: nil,
+		},
+		{
+			name: "events",
+			hook: &Webhook{Events: []string{report.ActionCreated}},
+			want: []string{"sync-completed other/api"},
+		},
+		{
+			name: "completed run listed",
+			hook: &Webhook{Paths: []string{"none/*"}, Events: []string{EventSyncCompleted}},
+			want: []string{"sync-completed "},
+		},
+		{
+			name:   "failed run",
+			hook:   &Webhook{Paths: []string{"none/*"}},
+			failed: true,
+			want:   []string{"sync-failed "},
+		},
+		{
+			name:   "failed run not listed",
+			hook:   &Webhook{Events: []string{report.ActionCreated}},
+			failed: true,
+			want:   []string{"sync-failed other/api"},
+		},
+		{
+			name: "secret",
+			hook: &Webhook{Mode: ModeSecret},
+			want: []string{"data-updated apps/db", "created other/api"},
+		},
+		{
+			name:   "secret with failed run",
+			hook:   &Webhook{Mode: ModeSecret, Paths: []string{"apps/*"}},
+			failed: true,
+			want:   []string{"data-updated apps/db", "sync-failed "},
+		},
+		{
+			name: "secret with aborted run",
+			hook: &Webhook{Mode: ModeSecret, Paths: []string{"none/*"}},
+			err:  errors.New("sync aborted"),
+			want: []string{"sync-failed "},
+		},
+		{
+			name:   "secret with failed run not listed",
+			hook:   &Webhook{Mode: ModeSecret, Events: []string{report.ActionDataUpdated}},
+			failed: true,
+			want:   []string{"data-updated apps/db"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := testJob()
+			if tt.failed {
+				job.Totals[report.ActionFailed] = 1
+			}
+
+			var got []string
+			for _, n := range tt.hook.notifications(job, tt.err) {
+				var names []string
+				for _, s := range n.Secrets {
+					names = append(names, s.Name)
+				}
+				got = append(got, n.Event+" "+strings.Join(names, ","))
+			}
+
+			if strings.Join(got, "; ") != strings.Join(tt.want, "; ") {
+				t.Errorf("notifications = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotificationErrorRedacted(t *testing.T) {
+	redact.Reset()
+	t.Cleanup(redact.Reset)
+	redact.Register(map[string]interface{}{"password": "hunter2-secret"})
+
+	notifications := (&Webhook{}).notifications(testJob(), errors.New("invalid value hunter2-secret"))
+	if len(notifications) != 1 {
+		t.Fatalf("got %d notifications, want 1", len(notifications))
+	}
+	if got, want := notifications[0].Error, "invalid value "+redact.Redacted; got != want {
+		t.Errorf("Error = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,152 @@
+package redact
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MinLength is the length of the shortest value scrubbed. Shorter values, such as "true" or a
+	// port number, are too common to scrub from logs.
+	MinLength = 6
+
+	// Redacted replaces secret values
+	Redacted = "<redacted>"
+)
+
+var (
+	lock     sync.Mutex
+	values   = make(map[string]bool)
+	replacer *strings.Replacer // Replacer of values, nil if outdated, see String
+)
+
+// Hook is a logrus hook scrubbing registered values from the message and fields of every entry.
+// Fields are scrubbed if they are strings, errors or fmt.Stringer, which are replaced with their
+// scrubbed string. Values of other types, such as numbers or structs, are logged as they are.
+type Hook struct{}
+
+// Levels returns all levels, so that every entry is scrubbed.
+func (Hook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire scrubs registered values from the message and the string, error and fmt.Stringer fields of
+// entry.
+func (Hook) Fire(entry *log.Entry) error {
+	entry.Message = String(entry.Message)
+
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = String(v)
+		case error:
+			entry.Data[key] = String(v.Error())
+		case fmt.Stringer:
+			entry.Data[key] = String(v.String())
+		}
+	}
+
+	return nil
+}
+
+// Register registers the string and number values in data, including those in nested maps and
+// lists, to be scrubbed until Reset. Numbers are registered as they are written. Values shorter than
+// MinLength are not registered.
+func Register(data map[string]interface{}) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	for _, value := range data {
+		if register(value) {
+			replacer = nil
+		}
+	}
+}
+
+// Reset unregisters all values. It's called before each sync job, so that values are registered
+// only while the secrets they belong to are synced, and do not pile up in a long-running process.
+func Reset() {
+	lock.Lock()
+	defer lock.Unlock()
+
+	values = make(map[string]bool)
+	replacer = nil
+}
+
+// String returns s with every registered value in it replaced with Redacted.
+func String(s string) string {
+	lock.Lock()
+	if replacer == nil && len(values) > 0 {
+		replacer = newReplacer()
+	}
+	r := replacer
+	lock.Unlock()
+
+	if r == nil {
+		return s
+	}
+
+	return r.Replace(s)
+}
+
+// newReplacer returns a strings.Replacer replacing registered values, longest first, so that a value
+// containing another is replaced as a whole. The lock must be held.
+func newReplacer() *strings.Replacer {
+	var sorted []string
+	for value := range values {
+		sorted = append(sorted, value)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+
+	var pairs []string
+	for _, value := range sorted {
+		pairs = append(pairs, value, Redacted)
+	}
+
+	return strings.NewReplacer(pairs...)
+}
+
+// register adds the string and number values in value to values. Returns a boolean indicating
+// whether any was added. The lock must be held.
+func register(value interface{}) bool {
+	var added bool
+
+	switch v := value.(type) {
+	case string:
+		added = registerString(v)
+	case json.Number:
+		added = registerString(v.String())
+	case map[string]interface{}:
+		for _, item := range v {
+			added = register(item) || added
+		}
+	case []interface{}:
+		for _, item := range v {
+			added = register(item) || added
+		}
+	}
+
+	return added
+}
+
+// registerString adds value to values, unless shorter than MinLength. Returns a boolean indicating
+// whether it was added. The lock must be held.
+func registerString(value string) bool {
+	if len(value) < MinLength || values[value] {
+		return false
+	}
+
+	values[value] = true
+
+	return true
+}
@@ -0,0 +1,34 @@
+package redact
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	t.Cleanup(Reset)
+
+	Register(map[string]interface{}{
+		"password": "p4ssw0rd",
+		"account":  json.Number("123456789012"),
+		"port":     json.Number("5432"),
+		"nested":   map[string]interface{}{"pin": json.Number("987654")},
+		"list":     []interface{}{"token-value"},
+	})
+
+	tests := []struct {
+		in, want string
+	}{
+		{"login with p4ssw0rd failed", "login with <redacted> failed"},
+		{"account 123456789012 denied", "account <redacted> denied"},
+		{"pin 987654", "pin <redacted>"},
+		{"sent token-value", "sent <redacted>"},
+		{"connect to port 5432", "connect to port 5432"},
+	}
+
+	for _, tt := range tests {
+		if got := String(tt.in); got != tt.want {
+			t.Errorf("String(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
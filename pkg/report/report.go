@@ -0,0 +1,253 @@
+package report
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync-secrets/pkg/redact"
+	"time"
+)
+
+const (
+	EnvFile = "REPORT_FILE"
+
+	// Stdout as the report file writes the report to standard output
+	Stdout = "-"
+
+	ActionCreated     = "created"
+	ActionDataUpdated = "data-updated" // Data, and possibly tags, updated
+	ActionDeleted     = "deleted"
+	ActionFailed      = "failed"  // Processing or writing the secret failed
+	ActionMoved       = "moved"   // Moved to another path, see Reason
+	ActionSkipped     = "skipped" // Left untouched on purpose, see Reason
+	ActionTagsUpdated = "tags-updated"
+	ActionUnchanged   = "unchanged"
+)
+
+var (
+	lock    sync.Mutex
+	report  = &Report{Start: time.Now().UTC()}
+	current *Job
+)
+
+// A Report of a run, with a Job for each sync job. Secret values are never included.
+type Report struct {
+	Version string    `json:"version,omitempty"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Jobs    []*Job    `json:"jobs"`
+}
+
+// A Job syncing secrets from Source to Destination, identified by their System and Identity.
+type Job struct {
+	Name        string         `json:"name"`
+	SyncID      string         `json:"sync_id"`
+	Environment string         `json:"environment"`
+	Source      *System        `json:"source,omitempty"`
+	Destination *System        `json:"destination,omitempty"`
+	Start       time.Time      `json:"start"`
+	End         time.Time      `json:"end"`
+	Secrets     []*Secret      `json:"secrets"`
+	Totals      map[string]int `json:"totals"`
+}
+
+// A System secrets are synced from or to.
+type System struct {
+	System   string `json:"system"`
+	Identity string `json:"identity"`
+}
+
+// The result of syncing a single Secret.
+type Secret struct {
+	Name   string   `json:"name"`
+	Action string   `json:"action"`
+	Reason string   `json:"reason,omitempty"`
+	Error  string   `json:"error,omitempty"`
+	Keys   []string `json:"keys,omitempty"` // Changed data keys, see RecordKeys
+}
+
+// EndJob ends the current job and returns it, or nil if there is no current job.
+func EndJob() *Job {
+	lock.Lock()
+	defer lock.Unlock()
+
+	job := current
+	if job != nil {
+		job.End = time.Now().UTC()
+		current = nil
+	}
+
+	return job
+}
+
+// Failed returns the number of secrets recorded as failed in all jobs of the report.
+func Failed() int {
+	lock.Lock()
+	defer lock.Unlock()
+
+	var failed int
+	for _, job := range report.Jobs {
+		failed += job.Totals[ActionFailed]
+	}
+
+	return failed
+}
+
+// Record records the action taken for the secret called name in the current job, with the reason
+// and error, if any. A later record for the same name replaces an earlier one, except that a move is
+// only replaced by a failure. Secret values are scrubbed from the error.
+func Record(name, action, reason string, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if current == nil {
+		startJob("", "", "")
+	}
+
+	s := &Secret{Name: name, Action: action, Reason: reason}
+	if err != nil {
+		s.Error = redact.String(err.Error())
+	}
+
+	for i, old := range current.Secrets {
+		if old.Name == name {
+			if old.Action == ActionMoved && action != ActionFailed {
+				return
+			}
+			current.Totals[old.Action]--
+			if current.Totals[old.Action] == 0 {
+				delete(current.Totals, old.Action)
+			}
+			current.Secrets[i] = s
+			current.Totals[action]++
+			return
+		}
+	}
+
+	current.Secrets = append(current.Secrets, s)
+	current.Totals[action]++
+}
+
+// RecordKeys records the data keys changed for the secret called name in the current job, as lines
+// of secret.DiffKeys. Does nothing if the secret has not been recorded.
+func RecordKeys(name string, keys []string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if current == nil {
+		return
+	}
+
+	for _, s := range current.Secrets {
+		if s.Name == name {
+			s.Keys = keys
+			return
+		}
+	}
+}
+
+// SetDestination sets the destination system of the current job, with the identity it is accessed
+// with.
+func SetDestination(system, identity string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if current == nil {
+		startJob("", "", "")
+	}
+	current.Destination = &System{System: system, Identity: identity}
+}
+
+// SetSource sets the source system of the current job, with the identity it is accessed with.
+func SetSource(system, identity string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if current == nil {
+		startJob("", "", "")
+	}
+	current.Source = &System{System: system, Identity: identity}
+}
+
+// Reset starts a new report, for a process running more than once, keeping the version. The current
+// job, if any, is discarded.
+func Reset() {
+	lock.Lock()
+	defer lock.Unlock()
+
+	report = &Report{Version: report.Version, Start: time.Now().UTC()}
+	current = nil
+}
+
+// SetVersion sets the version of secret-sync in the report.
+func SetVersion(version string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	report.Version = version
+}
+
+// StartJob starts a new job, to which secrets are recorded until EndJob.
+func StartJob(name, syncID, environment string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	startJob(name, syncID, environment)
+}
+
+// Write writes the report as JSON to the file in path, or to standard output if path is Stdout.
+func Write(path string) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	report.End = time.Now().UTC()
+	if report.Jobs == nil {
+		report.Jobs = []*Job{}
+	}
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	content = append(content, '\n')
+
+	if path == Stdout {
+		_, err := os.Stdout.Write(content)
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// startJob starts a new job. The lock must be held.
+func startJob(name, syncID, environment string) {
+	if current != nil {
+		current.End = time.Now().UTC()
+	}
+
+	current = &Job{
+		Name:        name,
+		SyncID:      syncID,
+		Environment: environment,
+		Start:       time.Now().UTC(),
+		Secrets:     []*Secret{},
+		Totals:      make(map[string]int),
+	}
+	report.Jobs = append(report.Jobs, current)
+}
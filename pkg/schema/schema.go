@@ -0,0 +1,198 @@
+package schema
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync-secrets/pkg/helper"
+	"sync-secrets/pkg/metrics"
+	"sync-secrets/pkg/secret"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const EnvRulesFile = "SCHEMA_RULES_FILE"
+
+// A Rule constrains the data of the secrets its Filter matches. Patterns, MinLength and MinEntropy
+// are keyed by key patterns, and apply to every key of the data matching them.
+type Rule struct {
+	Name string `json:"name"`
+	secret.Filter
+
+	Required   []string           `json:"required,omitempty"`    // Keys which must exist
+	Allowed    []string           `json:"allowed,omitempty"`     // Key patterns, other keys are not allowed
+	Patterns   map[string]string  `json:"patterns,omitempty"`    // Regular expressions values must match
+	MinLength  map[string]int     `json:"min_length,omitempty"`  // Minimum number of characters of values
+	MinEntropy map[string]float64 `json:"min_entropy,omitempty"` // Minimum Shannon entropy of values, in bits
+	NoEmpty    bool               `json:"no_empty,omitempty"`    // Values must not be empty
+
+	allowed  helper.Globs
+	keys     map[string]*regexp.Regexp // Compiled key patterns
+	patterns map[string]*regexp.Regexp
+}
+
+// Load reads schema rules from the JSON file in path and compiles their patterns.
+func Load(path string) ([]*Rule, error) {
+	var rules []*Rule
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := helper.DecodeJSON(content, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i, rule := range rules {
+		if err := rule.Compile(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d (%s): %w", path, i, rule.Name, err)
+		}
+	}
+
+	return rules, nil
+}
+
+// Apply validates each secret, and all its history versions, with the rules matching it. Secrets
+// with violations are failed, with all the violations as the reason.
+func Apply(rules []*Rule, secrets []*secret.Secret) {
+	var invalid int
+
+	for _, s := range secrets {
+		if s.Err != nil {
+			continue
+		}
+
+		var violations []string
+		for _, rule := range rules {
+			if !rule.Matches(s) {
+				continue
+			}
+			violations = append(violations, rule.Validate(s.Data)...)
+			for _, version := range s.History {
+				for _, v := range rule.Validate(version.Data) {
+					violations = append(violations, "version "+version.ID+": "+v)
+				}
+			}
+		}
+
+		if len(violations) > 0 {
+			invalid++
+			s.Fail(fmt.Errorf("schema: %s", strings.Join(violations, "; ")))
+			metrics.Add("secret_sync_invalid_secrets_total", "Secrets rejected by schema rules.", nil, 1)
+		}
+	}
+
+	metrics.Set("secret_sync_invalid_secrets", "Number of secrets rejected by schema rules.", nil, float64(invalid))
+
+	if invalid > 0 {
+		log.WithFields(log.Fields{
+			"count": invalid,
+		}).Warn("Secrets rejected by schema rules")
+	}
+}
+
+// Compile compiles the patterns and key patterns of the rule.
+func (r *Rule) Compile() error {
+	r.allowed = helper.CompileGlobs(r.Allowed)
+	r.keys = make(map[string]*regexp.Regexp)
+	r.patterns = make(map[string]*regexp.Regexp)
+
+	for key, pattern := range r.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("pattern for %s: %w", key, err)
+		}
+		r.patterns[key] = re
+		r.keys[key] = helper.CompileGlob(key)
+	}
+
+	for key := range r.MinLength {
+		r.keys[key] = helper.CompileGlob(key)
+	}
+	for key := range r.MinEntropy {
+		r.keys[key] = helper.CompileGlob(key)
+	}
+
+	return nil
+}
+
+// Validate returns the violations of the rule in data, prefixed with the name of the rule.
+func (r *Rule) Validate(data map[string]interface{}) []string {
+	var violations []string
+	violate := func(format string, a ...interface{}) {
+		violations = append(violations, fmt.Sprintf("%s: ", r.Name)+fmt.Sprintf(format, a...))
+	}
+
+	for _, key := range r.Required {
+		if _, ok := data[key]; !ok {
+			violate("missing required key %s", key)
+		}
+	}
+
+	// Sorted, so that violations are reported deterministically
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		val := data[key]
+		str := ""
+		if val != nil {
+			str = fmt.Sprint(val)
+		}
+
+		if len(r.Allowed) > 0 && !r.allowed.Match(key) {
+			violate("key %s is not allowed", key)
+		}
+
+		if r.NoEmpty && str == "" {
+			violate("key %s is empty", key)
+		}
+
+		for pattern, re := range r.patterns {
+			if r.keys[pattern].MatchString(key) && !re.MatchString(str) {
+				violate("key %s does not match %s", key, re)
+			}
+		}
+
+		for pattern, min := range r.MinLength {
+			if n := utf8.RuneCountInString(str); r.keys[pattern].MatchString(key) && n < min {
+				violate("key %s is %d characters, at least %d required", key, n, min)
+			}
+		}
+
+		for pattern, min := range r.MinEntropy {
+			if e := Entropy(str); r.keys[pattern].MatchString(key) && e < min {
+				violate("key %s has %.1f bits of entropy, at least %.1f required", key, e, min)
+			}
+		}
+	}
+
+	return violations
+}
+
+// Entropy returns the Shannon entropy of str in bits, the entropy per character times the number
+// of characters.
+func Entropy(str string) float64 {
+	counts := make(map[rune]int)
+	var n int
+	for _, r := range str {
+		counts[r]++
+		n++
+	}
+
+	var perChar float64
+	for _, count := range counts {
+		p := float64(count) / float64(n)
+		perChar -= p * math.Log2(p)
+	}
+
+	return perChar * float64(n)
+}
@@ -0,0 +1,126 @@
+package schema
+
+import (
+	"errors"
+	"reflect"
+	"sync-secrets/pkg/secret"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		rule *Rule
+		data map[string]interface{}
+		want []string // Violations
+	}{
+		{
+			name: "valid",
+			rule: &Rule{Required: []string{"user"}, Allowed: []string{"user", "pass*"}, NoEmpty: true},
+			data: map[string]interface{}{"user": "app", "password": "p"},
+		},
+		{
+			name: "required",
+			rule: &Rule{Required: []string{"user", "password"}},
+			data: map[string]interface{}{"user": "app"},
+			want: []string{"test: missing required key password"},
+		},
+		{
+			name: "allowed",
+			rule: &Rule{Allowed: []string{"db_*"}},
+			data: map[string]interface{}{"db_user": "app", "token": "t", "user": "u"},
+			want: []string{"test: key token is not allowed", "test: key user is not allowed"},
+		},
+		{
+			name: "pattern",
+			rule: &Rule{Patterns: map[string]string{"*_url": "^https://"}},
+			data: map[string]interface{}{"api_url": "http://api", "web_url": "https://web", "user": "app"},
+			want: []string{"test: key api_url does not match ^https://"},
+		},
+		{
+			name: "min length",
+			rule: &Rule{MinLength: map[string]int{"password": 8}},
+			data: map[string]interface{}{"password": "pässwö", "user": "u"},
+			want: []string{"test: key password is 6 characters, at least 8 required"},
+		},
+		{
+			name: "min entropy",
+			rule: &Rule{MinEntropy: map[string]float64{"*": 20}},
+			data: map[string]interface{}{"weak": "aaaaaaaa", "strong": "k9#Lq2!zX7@w"},
+			want: []string{"test: key weak has 0.0 bits of entropy, at least 20.0 required"},
+		},
+		{
+			name: "no empty",
+			rule: &Rule{NoEmpty: true},
+			data: map[string]interface{}{"user": "", "password": nil, "port": "5432"},
+			want: []string{"test: key password is empty", "test: key user is empty"},
+		},
+		{
+			name: "all violations",
+			rule: &Rule{Required: []string{"user"}, MinLength: map[string]int{"password": 8}, NoEmpty: true},
+			data: map[string]interface{}{"password": ""},
+			want: []string{
+				"test: missing required key user",
+				"test: key password is empty",
+				"test: key password is 0 characters, at least 8 required",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.Name = "test"
+			if err := tt.rule.Compile(); err != nil {
+				t.Fatalf("Compile() error = %v", err)
+			}
+
+			if got := tt.rule.Validate(tt.data); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	rules := []*Rule{
+		{Name: "apps", Filter: secret.Filter{Paths: []string{"apps/*"}}, Required: []string{"password"}},
+		{Name: "all", MinLength: map[string]int{"password": 8}},
+	}
+	for _, rule := range rules {
+		if err := rule.Compile(); err != nil {
+			t.Fatalf("Compile() error = %v", err)
+		}
+	}
+
+	valid := secret.New("apps/api")
+	valid.Data["password"] = "long enough"
+	invalid := secret.New("apps/db")
+	invalid.Data["password"] = "short"
+	unmatched := secret.New("shared/db")
+	failed := secret.New("apps/cache")
+	failed.Fail(errors.New("unreadable"))
+	history := secret.New("apps/queue")
+	history.Data["password"] = "long enough"
+	history.History = []*secret.Version{{ID: "3", Data: map[string]interface{}{"password": "short"}}}
+
+	Apply(rules, []*secret.Secret{valid, invalid, unmatched, failed, history})
+
+	for _, tt := range []struct {
+		secret *secret.Secret
+		want   string // Error the secret is failed with, if any
+	}{
+		{valid, ""},
+		{invalid, "schema: all: key password is 5 characters, at least 8 required"},
+		{unmatched, ""},
+		{failed, "unreadable"},
+		{history, "schema: version 3: all: key password is 5 characters, at least 8 required"},
+	} {
+		got := ""
+		if tt.secret.Err != nil {
+			got = tt.secret.Err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("Apply() error of %s = %q, want %q", tt.secret.Name, got, tt.want)
+		}
+	}
+}
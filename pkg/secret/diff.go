@@ -0,0 +1,47 @@
+package secret
+
+import (
+	"sort"
+	"sync-secrets/pkg/helper"
+)
+
+// DiffKeys returns a line per data key changed when cur is made equal to new, in order: "+ key" for
+// keys only in new, "~ key" for keys with different values and "- key" for keys only in cur. Either
+// may be nil, if the secret is created or deleted. Values are never included.
+func DiffKeys(new, cur *Secret) []string {
+	var lines []string
+	var newData, curData map[string]interface{}
+	if new != nil {
+		newData = new.Data
+	}
+	if cur != nil {
+		curData = cur.Data
+	}
+
+	for _, key := range sortedKeys(newData) {
+		if val, ok := curData[key]; !ok {
+			lines = append(lines, "+ "+key)
+		} else if !helper.Equal(newData[key], val) {
+			lines = append(lines, "~ "+key)
+		}
+	}
+
+	for _, key := range sortedKeys(curData) {
+		if _, ok := newData[key]; !ok {
+			lines = append(lines, "- "+key)
+		}
+	}
+
+	return lines
+}
+
+// sortedKeys returns the keys of data in order.
+func sortedKeys(data map[string]interface{}) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,99 @@
+package secret
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync-secrets/pkg/redact"
+)
+
+// Redacted replaces secret values when a Secret or Version is formatted or encoded as JSON
+const Redacted = redact.Redacted
+
+// String returns a description of s with the values of its data, and of its history, redacted.
+func (s Secret) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "{Name:%s Data:%v Tags:%v Meta:%v", s.Name, redactData(s.Data), s.Tags, s.Meta)
+	if s.Environment != nil {
+		fmt.Fprintf(&b, " Environment:%s", s.Environment.Name)
+	}
+	fmt.Fprintf(&b, " SourceID:%s Version:%s History:%v", s.SourceID, s.Version, s.History)
+	if s.Err != nil {
+		fmt.Fprintf(&b, " Err:%s", s.Err)
+	}
+	b.WriteString("}")
+
+	return b.String()
+}
+
+// GoString returns a Go-syntax representation of s with the values of its data, and of its
+// history, redacted.
+func (s Secret) GoString() string {
+	return fmt.Sprintf("&secret.Secret{Name:%q, Data:%#v, Tags:%#v, Meta:%#v, SourceID:%q, Version:%q, History:%#v}",
+		s.Name, redactData(s.Data), s.Tags, s.Meta, s.SourceID, s.Version, s.History)
+}
+
+// MarshalJSON encodes s as JSON with the values of its data, and of its history, redacted.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	output := struct {
+		Name        string                 `json:"name"`
+		Data        map[string]interface{} `json:"data"`
+		Environment string                 `json:"environment,omitempty"`
+		Tags        map[string]interface{} `json:"tags,omitempty"`
+		Meta        map[string]string      `json:"meta,omitempty"`
+		SourceID    string                 `json:"source_id,omitempty"`
+		Version     string                 `json:"version,omitempty"`
+		History     []*Version             `json:"history,omitempty"`
+		Err         string                 `json:"error,omitempty"`
+	}{
+		Name:     s.Name,
+		Data:     redactData(s.Data),
+		Tags:     s.Tags,
+		Meta:     s.Meta,
+		SourceID: s.SourceID,
+		Version:  s.Version,
+		History:  s.History,
+	}
+
+	if s.Environment != nil {
+		output.Environment = s.Environment.Name
+	}
+	if s.Err != nil {
+		output.Err = s.Err.Error()
+	}
+
+	return json.Marshal(output)
+}
+
+// String returns a description of v with the values of its data redacted.
+func (v Version) String() string {
+	return fmt.Sprintf("{ID:%s Data:%v}", v.ID, redactData(v.Data))
+}
+
+// GoString returns a Go-syntax representation of v with the values of its data redacted.
+func (v Version) GoString() string {
+	return fmt.Sprintf("&secret.Version{ID:%q, Data:%#v}", v.ID, redactData(v.Data))
+}
+
+// MarshalJSON encodes v as JSON with the values of its data redacted.
+func (v Version) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID   string                 `json:"id"`
+		Data map[string]interface{} `json:"data"`
+	}{v.ID, redactData(v.Data)})
+}
+
+// redactData returns a copy of data with each value replaced with Redacted. Keys are kept.
+func redactData(data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+
+	redacted := make(map[string]interface{}, len(data))
+	for key := range data {
+		redacted[key] = Redacted
+	}
+
+	return redacted
+}
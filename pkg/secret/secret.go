@@ -2,9 +2,12 @@ package secret
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync-secrets/pkg/helper"
+	"sync-secrets/pkg/redact"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -16,6 +19,38 @@ var (
 	ProdEnv    = Environment{Name: "prod", Production: true, IsGroup: false}
 	NonprodEnv = Environment{Name: "nonprod", Production: false, IsGroup: true}
 	GlobalEnv  = Environment{Name: "global", Production: true, IsGroup: true}
+
+	// ErrProduction fails production secrets blocked from a non-production environment
+	ErrProduction = errors.New("production secret")
+
+	// Environments lists all environments
+	Environments = []*Environment{&DevEnv, &TestEnv, &StagingEnv, &ProdEnv, &NonprodEnv, &GlobalEnv}
+
+	// MetaKeys lists all metadata keys secret-sync manages itself
+	MetaKeys = []string{
+		MetaContentHash, MetaDeletedAt, MetaMovedTo, MetaOriginalPath, MetaPayloadType, MetaSourceID,
+		MetaSourceVersion,
+	}
+)
+
+const (
+	// MetaPrefix prefixes all metadata keys secret-sync manages itself. Such keys are kept in
+	// Secret.Meta instead of Secret.Tags, so they never affect tag comparison.
+	MetaPrefix = "secret-sync/"
+
+	MetaContentHash   = MetaPrefix + "content-hash"
+	MetaDeletedAt     = MetaPrefix + "deleted-at"
+	MetaMovedTo       = MetaPrefix + "moved-to"
+	MetaOriginalPath  = MetaPrefix + "original-path"
+	MetaPayloadType   = MetaPrefix + "payload-type"
+	MetaSourceID      = MetaPrefix + "source-id"
+	MetaSourceVersion = MetaPrefix + "source-version"
+
+	// TagClassification marks a secret as production-classified when set to "production" or "prod"
+	TagClassification = "Classification"
+
+	HistoryAll    = -1 // Sync every live version of the source secret
+	HistoryLatest = 1  // Sync only the current version of the source secret
 )
 
 type Environment struct {
@@ -24,30 +59,123 @@ type Environment struct {
 	IsGroup    bool // true = environment is a group for multiple envs
 }
 
-// A secret containing name/path, map of data, and map of tags/metadata.
+// A secret containing name/path, map of data, and map of tags/metadata. Data is kept as decoded
+// from JSON, except that numbers are json.Number, so they are written exactly as they were read.
+// Values of Data are redacted when a Secret is formatted or encoded as JSON.
 type Secret struct {
 	Name        string
 	Data        map[string]interface{}
 	Environment *Environment
 	Tags        map[string]interface{}
+	Meta        map[string]string // Metadata managed by secret-sync, keys prefixed with MetaPrefix
+	SourceID    string            // Identifier of the secret in its system, kept if it's renamed
+	Version     string            // Identifier of the version Data was read from
+	History     []*Version        // Previous versions of the secret, oldest first
+	Err         error             // Reason the secret failed processing, if it did
+}
+
+// A single version of secret's data.
+type Version struct {
+	ID   string
+	Data map[string]interface{}
+}
+
+// A Filter selects secrets by name and tags. A secret matches if its name matches any of Paths (or
+// Paths is empty) and it has all Tags. A nil Filter matches all secrets.
+type Filter struct {
+	Paths []string          `json:"paths,omitempty" yaml:"paths,omitempty"`
+	Tags  map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
+
+	paths helper.Globs // Paths compiled on first use, see globs
+}
+
+// Matches returns a boolean indicating whether s matches f.
+func (f *Filter) Matches(s *Secret) bool {
+	if f == nil {
+		return true
+	}
+
+	if !s.MatchesTags(f.Tags) {
+		return false
+	}
+
+	if len(f.Paths) == 0 {
+		return true
+	}
+
+	return f.globs().Match(s.Name)
+}
+
+// PathsOnly returns a Filter with only the Paths of f, or nil if f is nil. Tags are matched in the
+// source only, as tags in the destination are mapped by tag rules.
+func (f *Filter) PathsOnly() *Filter {
+	if f == nil {
+		return nil
+	}
+
+	return &Filter{Paths: f.Paths}
+}
+
+// Narrow returns a Filter matching only the secrets called any of names which f matches by name,
+// with the Tags of f. Returns false if f matches none of names.
+func (f *Filter) Narrow(names ...string) (*Filter, bool) {
+	narrowed := &Filter{}
+	if f != nil {
+		narrowed.Tags = f.Tags
+	}
+
+	for _, name := range names {
+		if f == nil || len(f.Paths) == 0 {
+			narrowed.Paths = append(narrowed.Paths, name)
+			continue
+		}
+		if f.globs().Match(name) {
+			narrowed.Paths = append(narrowed.Paths, name)
+		}
+	}
+
+	return narrowed, len(narrowed.Paths) > 0
 }
 
-// New creates and returns a Secret with Data and Tags initialized.
+// globs returns f.Paths compiled, compiling them on first use.
+func (f *Filter) globs() helper.Globs {
+	if f.paths == nil {
+		f.paths = helper.CompileGlobs(f.Paths)
+	}
+
+	return f.paths
+}
+
+// New creates and returns a Secret with Data, Tags and Meta initialized.
 func New(name string) *Secret {
 	secret := Secret{
 		Name: name,
 		Data: make(map[string]interface{}),
 		Tags: make(map[string]interface{}),
+		Meta: make(map[string]string),
 	}
 
 	return &secret
 }
 
-// AddData appends given data to secret's Data.
+// AddData appends given data to secret's Data. The values are registered to be scrubbed from logs.
 func (s *Secret) AddData(data map[string]interface{}) {
 	for key, value := range data {
 		s.Data[key] = value
 	}
+	redact.Register(data)
+}
+
+// AddCustomMetadata appends given metadata to secret's Tags, except for keys prefixed with
+// MetaPrefix, which are appended to secret's Meta instead.
+func (s *Secret) AddCustomMetadata(metadata map[string]interface{}) {
+	for key, value := range metadata {
+		if strings.HasPrefix(key, MetaPrefix) {
+			s.Meta[key] = fmt.Sprintf("%v", value)
+		} else {
+			s.Tags[key] = value
+		}
+	}
 }
 
 // AddTags appends given tags to secret's Tags.
@@ -101,6 +229,32 @@ func (s *Secret) Equal(o *Secret) bool {
 	return s.EqualName(o) && s.EqualData(o) && s.EqualTags(o)
 }
 
+// CustomMetadata returns s.Tags and s.Meta merged into a single map.
+func (s *Secret) CustomMetadata() map[string]interface{} {
+	metadata := make(map[string]interface{}, len(s.Tags)+len(s.Meta))
+
+	for key, value := range s.Tags {
+		metadata[key] = value
+	}
+
+	for key, value := range s.Meta {
+		metadata[key] = value
+	}
+
+	return metadata
+}
+
+// DestinationName returns the name of s in the destination when synced to env: without the
+// environment suffix, unless env is a group.
+func (s *Secret) DestinationName(env *Environment) string {
+	trimmed := Secret{Name: s.Name}
+	if !env.IsGroup {
+		trimmed.TrimNameEnv()
+	}
+
+	return trimmed.Name
+}
+
 // EqualData returns a boolean indicating whether s.Data is equal to o.Data.
 func (s *Secret) EqualData(o *Secret) bool {
 	return helper.DeepEqual(s.Data, o.Data)
@@ -116,6 +270,18 @@ func (s *Secret) EqualTags(o *Secret) bool {
 	return helper.DeepEqual(s.Tags, o.Tags)
 }
 
+// Fail marks s as failed with err. Failed secrets are not written to the destination system, and
+// any existing value there is left untouched.
+func (s *Secret) Fail(err error) {
+	if s.Err == nil {
+		s.Err = err
+	}
+
+	log.WithFields(log.Fields{
+		"path": s.Name,
+	}).WithError(err).Error("Secret failed, leaving destination untouched")
+}
+
 // GetEnv returns the environment from s.Environment, s.Name, and from s.Tags, in that order.
 func (s *Secret) GetEnv() *Environment {
 	// If s.Environment is set, return that
@@ -163,11 +329,60 @@ func (s *Secret) GetTagValue(key string) string {
 	return val
 }
 
+// IsProduction returns a boolean indicating whether s is classified as production: its environment,
+// name suffix or Environment tag is prod, its path has a "prod" or "production" segment, or its
+// Classification tag is "production" or "prod". Secrets shared by all environments, in the global
+// environment or with no environment at all, are classified as production too, unless their
+// Classification tag has another value.
+func (s *Secret) IsProduction() bool {
+	for _, env := range []*Environment{s.Environment, s.GetEnvFromName(), s.GetEnvFromTags()} {
+		if env != nil && *env == ProdEnv {
+			return true
+		}
+	}
+
+	for _, segment := range strings.Split(s.Name, "/") {
+		if segment == ProdEnv.Name || segment == "production" {
+			return true
+		}
+	}
+
+	switch strings.ToLower(s.GetTagValue(TagClassification)) {
+	case ProdEnv.Name, "production":
+		return true
+	case "":
+		env := s.GetEnv()
+		return env == nil || *env == GlobalEnv
+	default:
+		return false
+	}
+}
+
+// MatchesTags returns a boolean indicating whether s has all given tags with the given values.
+func (s *Secret) MatchesTags(tags map[string]string) bool {
+	for key, val := range tags {
+		if !s.ContainsTag(key) || s.GetTagValue(key) != val {
+			return false
+		}
+	}
+
+	return true
+}
+
 // SetEnv retrieves the name of the environment and inserts it into s.Environment.
 func (s *Secret) SetEnv() {
 	s.Environment = s.GetEnv()
 }
 
+// Versions returns s.History followed by the current version of s.
+func (s *Secret) Versions() []*Version {
+	versions := make([]*Version, 0, len(s.History)+1)
+	versions = append(versions, s.History...)
+	versions = append(versions, &Version{ID: s.Version, Data: s.Data})
+
+	return versions
+}
+
 // TrimNameEnv removes any Environment.Name from s.Name. (For example, "dev/platform/my-secret-dev"
 // would be modified to "dev/platform/my-secret").
 func (s *Secret) TrimNameEnv() {
@@ -236,6 +451,24 @@ func FilterByTags(secrets []Secret, tags map[string]interface{}) (bool, []Secret
 	}
 }
 
+// ParseHistory parses the number of source versions to sync: "latest" (or empty), "all", or a
+// positive number of most recent versions.
+func ParseHistory(history string) (int, error) {
+	switch history {
+	case "", "latest":
+		return HistoryLatest, nil
+	case "all":
+		return HistoryAll, nil
+	}
+
+	n, err := strconv.Atoi(history)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s is not one of: latest, all, or a positive number", history)
+	}
+
+	return n, nil
+}
+
 // ParseFilterTags returns the tagsString (format "TAG1=VALUE1;TAG2=VALUE2") parsed into a map.
 func ParseFilterTags(tagsString string) map[string]interface{} {
 	tags := make(map[string]interface{})
@@ -0,0 +1,35 @@
+package secret
+
+import "testing"
+
+func TestIsProduction(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		tags map[string]interface{}
+		want bool
+	}{
+		{"dev", "apps/db", map[string]interface{}{"Environment": "dev"}, false},
+		{"prod tag", "apps/db", map[string]interface{}{"Environment": "prod"}, true},
+		{"prod suffix", "apps/db-prod", nil, true},
+		{"prod path", "production/apps/db", map[string]interface{}{"Environment": "dev"}, true},
+		{"classified", "apps/db", map[string]interface{}{"Environment": "dev", "Classification": "Production"}, true},
+		{"global", "apps/db", map[string]interface{}{"Environment": "global"}, true},
+		{"untagged", "apps/db", nil, true},
+		{"global classified otherwise", "apps/db", map[string]interface{}{"Environment": "global", "Classification": "internal"}, false},
+		{"untagged classified otherwise", "apps/db", map[string]interface{}{"Classification": "public"}, false},
+		{"prod suffix classified otherwise", "apps/db-prod", map[string]interface{}{"Classification": "public"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(tt.path)
+			s.AddTags(tt.tags)
+			s.SetEnv()
+
+			if got := s.IsProduction(); got != tt.want {
+				t.Errorf("IsProduction() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
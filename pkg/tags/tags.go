@@ -0,0 +1,140 @@
+package tags
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync-secrets/pkg/helper"
+	"sync-secrets/pkg/secret"
+	"unicode/utf8"
+)
+
+const EnvRulesFile = "TAG_RULES_FILE"
+
+// Rules select and rename the tags propagated between systems. A tag is kept if its key matches any
+// of Allow (or Allow is empty) and none of Deny. Kept tags are then renamed according to Rename.
+type Rules struct {
+	Allow  []string          `json:"allow,omitempty"`
+	Deny   []string          `json:"deny,omitempty"`
+	Rename map[string]string `json:"rename,omitempty"`
+
+	allow, deny helper.Globs // Allow and Deny compiled on first use, see Allowed
+}
+
+// Limits on the tags a system accepts. Zero values are not limited.
+type Limits struct {
+	MaxKeys          int
+	MaxKeyLength     int
+	MaxValueLength   int
+	ReservedPrefixes []string
+	Runes            bool // Lengths are in characters instead of bytes
+}
+
+// Load reads tag rules from the JSON file in path.
+func Load(path string) (*Rules, error) {
+	var rules Rules
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := helper.DecodeJSON(content, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &rules, nil
+}
+
+// Apply sets the tags of each secret as allowed and renamed by r, failing the secret if two tags
+// would get the same key. Nil rules keep all tags.
+func (r *Rules) Apply(secrets []*secret.Secret) {
+	if r == nil {
+		return
+	}
+
+	for _, s := range secrets {
+		if s.Err != nil {
+			continue
+		}
+
+		tags, err := r.Map(s.Tags)
+		if err != nil {
+			s.Fail(err)
+			continue
+		}
+		s.Tags = tags
+	}
+}
+
+// Map returns tags as allowed and renamed by r.
+func (r *Rules) Map(tags map[string]interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(tags))
+
+	for key, val := range tags {
+		if !r.Allowed(key) {
+			continue
+		}
+
+		newKey := key
+		if renamed, ok := r.Rename[key]; ok {
+			newKey = renamed
+		}
+
+		if _, ok := result[newKey]; ok {
+			return nil, fmt.Errorf("more than one tag would be named %s", newKey)
+		}
+		result[newKey] = val
+	}
+
+	return result, nil
+}
+
+// Allowed returns a boolean indicating whether a tag with key is propagated.
+func (r *Rules) Allowed(key string) bool {
+	if r.allow == nil {
+		r.allow = helper.CompileGlobs(r.Allow)
+		r.deny = helper.CompileGlobs(r.Deny)
+	}
+
+	return (len(r.Allow) == 0 || r.allow.Match(key)) && !r.deny.Match(key)
+}
+
+// Validate returns an error describing the first limit tags exceed, if any.
+func (l *Limits) Validate(tags map[string]interface{}) error {
+	unit := "bytes"
+	if l.Runes {
+		unit = "characters"
+	}
+
+	if l.MaxKeys > 0 && len(tags) > l.MaxKeys {
+		return fmt.Errorf("%d tags, at most %d allowed", len(tags), l.MaxKeys)
+	}
+
+	for key, val := range tags {
+		for _, prefix := range l.ReservedPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				return fmt.Errorf("tag %s: prefix %s is reserved", key, prefix)
+			}
+		}
+
+		if n := l.length(key); l.MaxKeyLength > 0 && n > l.MaxKeyLength {
+			return fmt.Errorf("tag %s: key is %d %s, at most %d allowed", key, n, unit, l.MaxKeyLength)
+		}
+
+		if n := l.length(fmt.Sprint(val)); l.MaxValueLength > 0 && n > l.MaxValueLength {
+			return fmt.Errorf("tag %s: value is %d %s, at most %d allowed", key, n, unit, l.MaxValueLength)
+		}
+	}
+
+	return nil
+}
+
+// length returns the length of str in the unit of l.
+func (l *Limits) length(str string) int {
+	if l.Runes {
+		return utf8.RuneCountInString(str)
+	}
+
+	return len(str)
+}
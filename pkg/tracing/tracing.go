@@ -0,0 +1,139 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync-secrets/pkg/helper"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	EnvEndpoint = "OTLP_ENDPOINT"
+
+	OutcomeConflict = "conflict"
+	OutcomeError    = "error"
+	OutcomeNotFound = "not-found"
+	OutcomeOK       = "ok"
+
+	serviceName = "secret-sync"
+)
+
+var provider *sdktrace.TracerProvider
+
+// Setup exports traces over OTLP/HTTP to the endpoint in OTLP_ENDPOINT env variable, such as
+// "http://localhost:4318", if defined. Otherwise spans are not recorded. Trace context is
+// propagated in W3C Trace Context headers, see Transport.
+func Setup(version string) error {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	endpoint := helper.Getenv("", EnvEndpoint)
+	if endpoint == "" {
+		return nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid %s: %s", EnvEndpoint, endpoint)
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	if u.Path != "" && u.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(u.Path))
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return err
+	}
+
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion(version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return nil
+}
+
+// Shutdown exports any spans not yet exported and stops tracing.
+func Shutdown() {
+	if provider != nil {
+		provider.Shutdown(context.Background())
+		provider = nil
+	}
+}
+
+// Start starts a span called name, as a child of the span in ctx, if any. Returns also a copy of
+// ctx with the new span. Attributes must never include secret values.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(serviceName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartBackend starts a span called name for a call to backend, such as "vault", on the secret in
+// path, if not empty. See Start.
+func StartBackend(ctx context.Context, name, backend, path string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{attribute.String("backend", backend)}
+	if path != "" {
+		attrs = append(attrs, attribute.String("path", path))
+	}
+
+	return Start(ctx, name, attrs...)
+}
+
+// End ends span, with outcome OutcomeError if err is not nil, or OutcomeOK. The error message is
+// not recorded, as errors of backends may echo secret values.
+func End(span trace.Span, err error) {
+	if err != nil {
+		EndWith(span, OutcomeError)
+		return
+	}
+
+	EndWith(span, OutcomeOK)
+}
+
+// EndWith ends span with outcome.
+func EndWith(span trace.Span, outcome string) {
+	span.SetAttributes(attribute.String("outcome", outcome))
+	if outcome == OutcomeError {
+		span.SetStatus(codes.Error, "")
+	}
+
+	span.End()
+}
+
+// Transport returns an http.RoundTripper which sends requests with base, adding the trace context
+// of their span, if any, in headers.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return transport{base: base}
+}
+
+// A transport adding trace context headers to requests.
+type transport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip sends req with the trace context of its span in headers.
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+
+	return t.base.RoundTrip(req)
+}
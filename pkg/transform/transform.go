@@ -0,0 +1,329 @@
+package transform
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync-secrets/pkg/helper"
+	"sync-secrets/pkg/secret"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EnvRulesFile = "TRANSFORM_RULES_FILE"
+
+	CaseCamel          = "camel"           // dbPassword
+	CaseKebab          = "kebab"           // db-password
+	CaseLower          = "lower"           // dbpassword
+	CaseScreamingSnake = "screaming-snake" // DB_PASSWORD
+	CaseSnake          = "snake"           // db_password
+	CaseUpper          = "upper"           // DBPASSWORD
+)
+
+// A Rule transforms the keys of Secret.Data for the secrets its Filter matches. Operations are
+// applied in the order of the fields below.
+type Rule struct {
+	Name string `json:"name"`
+	secret.Filter
+
+	Flatten   string                 `json:"flatten,omitempty"`   // Separator to join nested keys with
+	Unflatten string                 `json:"unflatten,omitempty"` // Separator to split keys into nested ones by
+	Rename    map[string]string      `json:"rename,omitempty"`    // Old key to new key
+	KeyCase   string                 `json:"key_case,omitempty"`  // One of the Case constants
+	Keep      []string               `json:"keep,omitempty"`      // Keys (globs) to keep, dropping others
+	Drop      []string               `json:"drop,omitempty"`      // Keys (globs) to drop
+	Add       map[string]interface{} `json:"add,omitempty"`       // Constant keys to add
+
+	keep, drop helper.Globs
+}
+
+// Load reads transform rules from the JSON file in path and compiles their key patterns.
+func Load(path string) ([]*Rule, error) {
+	var rules []*Rule
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := helper.DecodeJSON(content, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i, rule := range rules {
+		if err := rule.Compile(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d (%s): %w", path, i, rule.Name, err)
+		}
+	}
+
+	return rules, nil
+}
+
+// Apply transforms the data of each secret with each rule matching it, in order. If a rule cannot
+// be applied, the secret is failed.
+func Apply(rules []*Rule, secrets []*secret.Secret) {
+	for _, s := range secrets {
+		for _, rule := range rules {
+			if s.Err != nil || !rule.Matches(s) {
+				continue
+			}
+
+			if err := rule.Transform(s); err != nil {
+				s.Fail(fmt.Errorf("transform %s: %w", rule.Name, err))
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"path": s.Name,
+				"rule": rule.Name,
+			}).Debug("Transformed secret data")
+		}
+	}
+}
+
+// Compile validates the rule and compiles its key patterns.
+func (r *Rule) Compile() error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	r.keep = helper.CompileGlobs(r.Keep)
+	r.drop = helper.CompileGlobs(r.Drop)
+
+	return nil
+}
+
+// Transform applies the rule to the data of s and all its history versions.
+func (r *Rule) Transform(s *secret.Secret) error {
+	data, err := r.transformData(s.Data)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range s.History {
+		if version.Data, err = r.transformData(version.Data); err != nil {
+			return fmt.Errorf("version %s: %w", version.ID, err)
+		}
+	}
+
+	s.Data = data
+
+	return nil
+}
+
+// Validate returns an error if the rule is not valid.
+func (r *Rule) Validate() error {
+	switch r.KeyCase {
+	case "", CaseCamel, CaseKebab, CaseLower, CaseScreamingSnake, CaseSnake, CaseUpper:
+	default:
+		return fmt.Errorf("key_case should be one of: %s, %s, %s, %s, %s, %s", CaseCamel, CaseKebab,
+			CaseLower, CaseScreamingSnake, CaseSnake, CaseUpper)
+	}
+
+	if r.Flatten != "" && r.Unflatten != "" {
+		return fmt.Errorf("flatten and unflatten cannot be used in the same rule")
+	}
+
+	return nil
+}
+
+// transformData returns a transformed copy of data.
+func (r *Rule) transformData(data map[string]interface{}) (map[string]interface{}, error) {
+	var err error
+	result := make(map[string]interface{}, len(data))
+	for key, val := range data {
+		result[key] = val
+	}
+
+	if r.Flatten != "" {
+		result = flatten(result, r.Flatten)
+	}
+
+	if r.Unflatten != "" {
+		if result, err = unflatten(result, r.Unflatten); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := setKeys(result, r.Rename, func(key string) string { return key }); err != nil {
+		return nil, err
+	}
+
+	if r.KeyCase != "" {
+		if err := setKeys(result, nil, func(key string) string { return ChangeCase(key, r.KeyCase) }); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(r.Keep) > 0 {
+		for key := range result {
+			if !r.keep.Match(key) {
+				delete(result, key)
+			}
+		}
+	}
+
+	for key := range result {
+		if r.drop.Match(key) {
+			delete(result, key)
+		}
+	}
+
+	for key, val := range r.Add {
+		result[key] = val
+	}
+
+	return result, nil
+}
+
+// ChangeCase returns key in keyCase. Words in key are separated by "_", "-", ".", spaces, or by a
+// change from lower to upper case.
+func ChangeCase(key, keyCase string) string {
+	words := splitWords(key)
+
+	switch keyCase {
+	case CaseCamel:
+		for i, word := range words {
+			word = strings.ToLower(word)
+			if i > 0 && len(word) > 0 {
+				word = strings.ToUpper(word[:1]) + word[1:]
+			}
+			words[i] = word
+		}
+		return strings.Join(words, "")
+	case CaseKebab:
+		return strings.ToLower(strings.Join(words, "-"))
+	case CaseLower:
+		return strings.ToLower(key)
+	case CaseScreamingSnake:
+		return strings.ToUpper(strings.Join(words, "_"))
+	case CaseSnake:
+		return strings.ToLower(strings.Join(words, "_"))
+	case CaseUpper:
+		return strings.ToUpper(key)
+	default:
+		return key
+	}
+}
+
+// flatten returns data with nested objects joined into top-level keys with sep, e.g.
+// {"db": {"user": "x"}} with "_" becomes {"db_user": "x"}.
+func flatten(data map[string]interface{}, sep string) map[string]interface{} {
+	result := make(map[string]interface{})
+
+	for key, val := range data {
+		if nested, ok := val.(map[string]interface{}); ok && len(nested) > 0 {
+			for nestedKey, nestedVal := range flatten(nested, sep) {
+				result[key+sep+nestedKey] = nestedVal
+			}
+		} else {
+			result[key] = val
+		}
+	}
+
+	return result
+}
+
+// setKeys renames keys of data in place, first according to renames and then with fn. Returns an
+// error if two keys would be renamed to the same key.
+func setKeys(data map[string]interface{}, renames map[string]string, fn func(string) string) error {
+	result := make(map[string]interface{}, len(data))
+
+	for key, val := range data {
+		newKey := key
+		if renamed, ok := renames[key]; ok {
+			newKey = renamed
+		}
+		newKey = fn(newKey)
+
+		if _, ok := result[newKey]; ok {
+			return fmt.Errorf("more than one key would be named %s", newKey)
+		}
+		result[newKey] = val
+	}
+
+	for key := range data {
+		delete(data, key)
+	}
+	for key, val := range result {
+		data[key] = val
+	}
+
+	return nil
+}
+
+// splitWords returns the words in key.
+func splitWords(key string) []string {
+	var words []string
+	var word []rune
+
+	runes := []rune(key)
+	for i, r := range runes {
+		if r == '_' || r == '-' || r == '.' || unicode.IsSpace(r) {
+			if len(word) > 0 {
+				words = append(words, string(word))
+			}
+			word = nil
+			continue
+		}
+
+		if unicode.IsUpper(r) && len(word) > 0 &&
+			(unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+			words = append(words, string(word))
+			word = nil
+		}
+
+		word = append(word, r)
+	}
+
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+
+	return words
+}
+
+// unflatten returns data with keys containing sep split into nested objects, e.g. {"db_user": "x"}
+// with "_" becomes {"db": {"user": "x"}}. Returns an error if a key is both a value and an object.
+func unflatten(data map[string]interface{}, sep string) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+
+	// Sorted, so that conflicts are reported deterministically
+	var keys []string
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		parts := strings.Split(key, sep)
+		node := result
+
+		for i, part := range parts {
+			if i == len(parts)-1 {
+				if _, ok := node[part]; ok {
+					return nil, fmt.Errorf("key %s conflicts with another key", key)
+				}
+				node[part] = data[key]
+				break
+			}
+
+			next, ok := node[part]
+			if !ok {
+				next = make(map[string]interface{})
+				node[part] = next
+			}
+
+			nested, ok := next.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("key %s conflicts with another key", key)
+			}
+			node = nested
+		}
+	}
+
+	return result, nil
+}
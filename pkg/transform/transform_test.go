@@ -0,0 +1,170 @@
+package transform
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync-secrets/pkg/secret"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name string
+		rule *Rule
+		data map[string]interface{}
+		want map[string]interface{}
+		err  string // Reason the secret is failed with, if any
+	}{
+		{
+			name: "flatten",
+			rule: &Rule{Flatten: "_"},
+			data: map[string]interface{}{"db": map[string]interface{}{"user": "app", "tls": map[string]interface{}{"ca": "x"}}},
+			want: map[string]interface{}{"db_user": "app", "db_tls_ca": "x"},
+		},
+		{
+			name: "unflatten",
+			rule: &Rule{Unflatten: "."},
+			data: map[string]interface{}{"db.user": "app", "db.port": "5432", "token": "t"},
+			want: map[string]interface{}{"db": map[string]interface{}{"user": "app", "port": "5432"}, "token": "t"},
+		},
+		{
+			name: "unflatten conflict",
+			rule: &Rule{Unflatten: "."},
+			data: map[string]interface{}{"db": "x", "db.user": "app"},
+			err:  "transform test: key db.user conflicts with another key",
+		},
+		{
+			name: "rename",
+			rule: &Rule{Rename: map[string]string{"pass": "password"}},
+			data: map[string]interface{}{"pass": "p", "user": "app"},
+			want: map[string]interface{}{"password": "p", "user": "app"},
+		},
+		{
+			name: "rename collision",
+			rule: &Rule{Rename: map[string]string{"pass": "password"}},
+			data: map[string]interface{}{"pass": "p", "password": "q"},
+			err:  "transform test: more than one key would be named password",
+		},
+		{
+			name: "screaming snake case",
+			rule: &Rule{KeyCase: CaseScreamingSnake},
+			data: map[string]interface{}{"dbPassword": "p", "api-key": "k", "HTTPServer": "s"},
+			want: map[string]interface{}{"DB_PASSWORD": "p", "API_KEY": "k", "HTTP_SERVER": "s"},
+		},
+		{
+			name: "camel case",
+			rule: &Rule{KeyCase: CaseCamel},
+			data: map[string]interface{}{"DB_PASSWORD": "p", "api.key": "k"},
+			want: map[string]interface{}{"dbPassword": "p", "apiKey": "k"},
+		},
+		{
+			name: "kebab case",
+			rule: &Rule{KeyCase: CaseKebab},
+			data: map[string]interface{}{"dbPassword": "p"},
+			want: map[string]interface{}{"db-password": "p"},
+		},
+		{
+			name: "case collision",
+			rule: &Rule{KeyCase: CaseLower},
+			data: map[string]interface{}{"Key": "a", "KEY": "b"},
+			err:  "transform test: more than one key would be named key",
+		},
+		{
+			name: "keep and drop",
+			rule: &Rule{Keep: []string{"db_*"}, Drop: []string{"*_old"}},
+			data: map[string]interface{}{"db_user": "app", "db_pass_old": "x", "token": "t"},
+			want: map[string]interface{}{"db_user": "app"},
+		},
+		{
+			name: "add",
+			rule: &Rule{Add: map[string]interface{}{"region": "eu-west-1", "user": "fixed"}},
+			data: map[string]interface{}{"user": "app"},
+			want: map[string]interface{}{"user": "fixed", "region": "eu-west-1"},
+		},
+		{
+			name: "in order",
+			rule: &Rule{Flatten: "_", Rename: map[string]string{"db_pass": "db_password"}, KeyCase: CaseUpper},
+			data: map[string]interface{}{"db": map[string]interface{}{"pass": "p"}},
+			want: map[string]interface{}{"DB_PASSWORD": "p"},
+		},
+		{
+			name: "path not matched",
+			rule: &Rule{Filter: secret.Filter{Paths: []string{"other/*"}}, KeyCase: CaseUpper},
+			data: map[string]interface{}{"user": "app"},
+			want: map[string]interface{}{"user": "app"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.Name = "test"
+			if err := tt.rule.Compile(); err != nil {
+				t.Fatalf("Compile() error = %v", err)
+			}
+
+			s := secret.New("apps/db")
+			s.Data = tt.data
+			Apply([]*Rule{tt.rule}, []*secret.Secret{s})
+
+			if tt.err != "" {
+				if s.Err == nil || s.Err.Error() != tt.err {
+					t.Errorf("Apply() failed secret with %v, want %q", s.Err, tt.err)
+				}
+				return
+			}
+			if s.Err != nil {
+				t.Fatalf("Apply() failed secret with %v", s.Err)
+			}
+			if !reflect.DeepEqual(s.Data, tt.want) {
+				t.Errorf("Apply() data = %v, want %v", s.Data, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyHistory(t *testing.T) {
+	rule := &Rule{Name: "upper", KeyCase: CaseUpper}
+	if err := rule.Compile(); err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+
+	s := secret.New("apps/db")
+	s.Data = map[string]interface{}{"user": "app"}
+	s.History = []*secret.Version{{ID: "1", Data: map[string]interface{}{"user": "old"}}}
+	failed := secret.New("apps/failed")
+	failed.Data = map[string]interface{}{"user": "app"}
+	failed.Fail(errors.New("unreadable"))
+
+	Apply([]*Rule{rule}, []*secret.Secret{s, failed})
+
+	if want := map[string]interface{}{"USER": "old"}; !reflect.DeepEqual(s.History[0].Data, want) {
+		t.Errorf("Apply() history data = %v, want %v", s.History[0].Data, want)
+	}
+	if want := map[string]interface{}{"user": "app"}; !reflect.DeepEqual(failed.Data, want) {
+		t.Errorf("Apply() data of failed secret = %v, want it skipped", failed.Data)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		rule *Rule
+		want string // Error, if any
+	}{
+		{"valid", &Rule{Flatten: "_", KeyCase: CaseSnake}, ""},
+		{"unknown key case", &Rule{KeyCase: "pascal"}, "key_case should be one of"},
+		{"flatten and unflatten", &Rule{Flatten: "_", Unflatten: "."}, "flatten and unflatten cannot be used in the same rule"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Validate()
+			if tt.want == "" && err != nil {
+				t.Errorf("Validate() error = %v", err)
+			} else if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package vault
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync-secrets/pkg/helper"
+	"sync-secrets/pkg/tracing"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"golang.org/x/time/rate"
+)
+
+const (
+	DefaultClientTimeout = 60 * time.Second
+	DefaultMaxRetries    = 2
+)
+
+// newConfig returns a vault.Config for the Vault instance configured with envPrefix. The settings
+// the Vault API reads from the process-wide environment are discarded and read again with
+// helper.Getenv, so that e.g. "SOURCE_VAULT_CACERT" and "DEST_VAULT_CACERT" can point to different
+// CAs. Unprefixed variables still apply to every instance which has no prefixed value.
+func newConfig(envPrefix string) (*vault.Config, error) {
+	config := vault.DefaultConfig()
+	if config.Error != nil {
+		return nil, config.Error
+	}
+
+	transport, ok := config.HttpClient.Transport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("unsupported HTTP client transport type %T", config.HttpClient.Transport)
+	}
+
+	// Reset anything vault.DefaultConfig() read from the environment
+	transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	transport.Proxy = http.ProxyFromEnvironment
+	config.Limiter = nil
+	config.MaxRetries = DefaultMaxRetries
+	config.Timeout = DefaultClientTimeout
+
+	tlsConfig := vault.TLSConfig{
+		CACert:        helper.Getenv(envPrefix, vault.EnvVaultCACert),
+		CACertBytes:   []byte(helper.Getenv(envPrefix, vault.EnvVaultCACertBytes)),
+		CAPath:        helper.Getenv(envPrefix, vault.EnvVaultCAPath),
+		ClientCert:    helper.Getenv(envPrefix, vault.EnvVaultClientCert),
+		ClientKey:     helper.Getenv(envPrefix, vault.EnvVaultClientKey),
+		TLSServerName: helper.Getenv(envPrefix, vault.EnvVaultTLSServerName),
+	}
+
+	if e := helper.Getenv(envPrefix, vault.EnvVaultSkipVerify); e != "" {
+		insecure, err := strconv.ParseBool(e)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", envPrefix+vault.EnvVaultSkipVerify, err)
+		}
+		tlsConfig.Insecure = insecure
+	}
+
+	if err := config.ConfigureTLS(&tlsConfig); err != nil {
+		return nil, fmt.Errorf("could not configure TLS: %w", err)
+	}
+
+	if e := helper.Getenv(envPrefix, vault.EnvVaultClientTimeout); e != "" {
+		timeout, err := parseDurationSecond(e)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", envPrefix+vault.EnvVaultClientTimeout, err)
+		}
+		config.Timeout = timeout
+	}
+
+	if e := helper.Getenv(envPrefix, vault.EnvVaultMaxRetries); e != "" {
+		maxRetries, err := strconv.ParseUint(e, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", envPrefix+vault.EnvVaultMaxRetries, err)
+		}
+		config.MaxRetries = int(maxRetries)
+	}
+
+	if e := helper.Getenv(envPrefix, vault.EnvRateLimit); e != "" {
+		limit, burst, err := parseRateLimit(e)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", envPrefix+vault.EnvRateLimit, err)
+		}
+		config.Limiter = rate.NewLimiter(rate.Limit(limit), burst)
+	}
+
+	// VAULT_PROXY_ADDR supersedes VAULT_HTTP_PROXY
+	proxy := helper.Getenv(envPrefix, vault.EnvHTTPProxy)
+	if e := helper.Getenv(envPrefix, vault.EnvVaultProxyAddr); e != "" {
+		proxy = e
+	}
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse proxy address: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	config.HttpClient.Transport = tracing.Transport(transport)
+
+	return config, nil
+}
+
+// parseDurationSecond parses a duration such as "30s" or "2m". A plain integer is read as seconds.
+func parseDurationSecond(val string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(val); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	return time.ParseDuration(val)
+}
+
+// parseDurationDays parses a duration such as "12h" or "30d". A plain integer is read as seconds.
+func parseDurationDays(val string) (time.Duration, error) {
+	if days, err := strconv.Atoi(strings.TrimSuffix(val, "d")); err == nil && strings.HasSuffix(val, "d") {
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	return parseDurationSecond(val)
+}
+
+// parseRateLimit parses a rate limit in format "rate:burst", or just "rate" in which case burst
+// equals rate. This is the same format the Vault API uses for VAULT_RATE_LIMIT.
+func parseRateLimit(val string) (float64, int, error) {
+	var limit float64
+	var burst int
+
+	if _, err := fmt.Sscanf(val, "%f:%d", &limit, &burst); err == nil {
+		return limit, burst, nil
+	}
+
+	limit, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s is not in format rate[:burst]", val)
+	}
+
+	return limit, int(limit), nil
+}
@@ -0,0 +1,72 @@
+package vault
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync-secrets/pkg/helper"
+
+	vault "github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	hashKeyPath = InternalPrefix + "hash-key"
+
+	// hashKeyLength is the length in bytes of hash keys generated
+	hashKeyLength = 32
+)
+
+// hash returns the keyed hash of data, see helper.HMAC and hashKey.
+func (v *Vault) hash(data interface{}) string {
+	return helper.HMAC(v.hashKey(), data)
+}
+
+// hashKey returns v.HashKey. If not configured, the key is read from Vault, where it's generated
+// on first use, so that all runs and replicas hash with the same key. With v.DryRun, a key that
+// cannot be read is generated but not written. Exits if the key cannot be read nor written.
+func (v *Vault) hashKey() []byte {
+	if v.HashKey != nil {
+		return v.HashKey
+	}
+
+	fields := log.Fields{
+		"path":   hashKeyPath,
+		"system": "HashiCorp Vault",
+	}
+	kv := v.Client.KVv2(v.Engine)
+
+	for attempt := 1; ; attempt++ {
+		vs, err := kv.Get(v.Context, hashKeyPath)
+		if err == nil && vs.Data != nil {
+			if key, ok := vs.Data["key"].(string); ok && key != "" {
+				v.HashKey = []byte(key)
+				return v.HashKey
+			}
+		} else if err != nil && !errors.Is(err, vault.ErrSecretNotFound) && !v.DryRun {
+			log.WithFields(fields).WithError(err).Fatal("Unable to read hash key")
+		}
+
+		random := make([]byte, hashKeyLength)
+		if _, err := rand.Read(random); err != nil {
+			log.WithFields(fields).WithError(err).Fatal("Unable to generate hash key")
+		}
+		key := hex.EncodeToString(random)
+
+		if v.DryRun {
+			v.HashKey = []byte(key)
+			return v.HashKey
+		}
+
+		// Check-and-set keeps the key of another replica generating it at the same time
+		data := map[string]interface{}{"key": key}
+		_, err = kv.Put(v.Context, hashKeyPath, data, vault.WithCheckAndSet(v.getCurrentVersion(hashKeyPath)))
+		if err == nil {
+			log.WithFields(fields).Info("Generated hash key")
+			v.HashKey = []byte(key)
+			return v.HashKey
+		} else if !isCASError(err) || attempt == maxCASAttempts {
+			log.WithFields(fields).WithError(err).Fatal("Unable to write hash key")
+		}
+	}
+}
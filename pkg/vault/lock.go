@@ -0,0 +1,108 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	lockPath = InternalPrefix + "locks/"
+
+	// lockMaxVersions limits the versions kept of a lock, as each renewal writes a new one
+	lockMaxVersions = 10
+)
+
+// AcquireLock acquires the lock called name for holder until ttl from now, or renews it if holder
+// already has it. Returns false if another holder has the lock and it has not expired. The lock is
+// written with check-and-set against the version read, so of concurrent attempts only one succeeds.
+// Expiry is compared with the local clock, so clocks of holders should be roughly in sync. Requests
+// are bound to ctx, so that a renewal cannot block past the deadline of the holder.
+func (v *Vault) AcquireLock(
+	ctx context.Context, name, holder string, ttl time.Duration,
+) (bool, error) {
+	path := lockPath + name
+	now := time.Now().UTC()
+
+	cas, current, expires, err := v.readLock(ctx, path)
+	if err != nil {
+		return false, err
+	}
+
+	if current != "" && current != holder && now.Before(expires) {
+		return false, nil
+	}
+
+	data := map[string]interface{}{
+		"holder":  holder,
+		"expires": now.Add(ttl).Format(time.RFC3339Nano),
+	}
+
+	_, err = v.Client.KVv2(v.Engine).Put(ctx, path, data, vault.WithCheckAndSet(cas))
+	if isCASError(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if cas == 0 {
+		metadata := vault.KVMetadataPutInput{MaxVersions: lockMaxVersions}
+		if err := v.Client.KVv2(v.Engine).PutMetadata(ctx, path, metadata); err != nil {
+			log.WithFields(log.Fields{
+				"path":   path,
+				"system": "HashiCorp Vault",
+			}).WithError(err).Warn("Unable to limit lock versions")
+		}
+	}
+
+	return true, nil
+}
+
+// ReleaseLock releases the lock called name, if holder has it, so that others can acquire it
+// without waiting for it to expire.
+func (v *Vault) ReleaseLock(ctx context.Context, name, holder string) error {
+	path := lockPath + name
+
+	cas, current, _, err := v.readLock(ctx, path)
+	if err != nil || current != holder {
+		return err
+	}
+
+	data := map[string]interface{}{
+		"holder":  "",
+		"expires": time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	_, err = v.Client.KVv2(v.Engine).Put(ctx, path, data, vault.WithCheckAndSet(cas))
+	if isCASError(err) {
+		// Taken over in between, so it's no longer ours to release
+		return nil
+	}
+
+	return err
+}
+
+// readLock returns the current version of the lock in path, its holder and when it expires. The
+// holder is empty if the lock does not exist or has been released.
+func (v *Vault) readLock(ctx context.Context, path string) (int, string, time.Time, error) {
+	vs, err := v.Client.KVv2(v.Engine).Get(ctx, path)
+	if errors.Is(err, vault.ErrSecretNotFound) {
+		// Check-and-set is against the current version, even if it has been deleted
+		metadata, err := v.Client.KVv2(v.Engine).GetMetadata(ctx, path)
+		if err != nil {
+			return 0, "", time.Time{}, nil
+		}
+		return metadata.CurrentVersion, "", time.Time{}, nil
+	} else if err != nil {
+		return 0, "", time.Time{}, err
+	}
+
+	holder, _ := vs.Data["holder"].(string)
+	raw, _ := vs.Data["expires"].(string)
+	expires, _ := time.Parse(time.RFC3339Nano, raw)
+
+	return vs.VersionMetadata.Version, holder, expires, nil
+}
@@ -0,0 +1,307 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync-secrets/pkg/audit"
+	"sync-secrets/pkg/helper"
+	"sync-secrets/pkg/secret"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	RenameContent = "content" // Match renamed secrets by source ID, or by identical content
+	RenameID      = "id"      // Match renamed secrets by source ID only
+	RenameOff     = "off"     // Do not detect renames
+)
+
+// A secret renamed in the source system: from is currently in Vault, to is the source secret.
+type move struct {
+	from *secret.Secret
+	to   *secret.Secret
+}
+
+// A redirect tombstone left in the old path of a secret moved to movedTo, see deleteMovedSecret.
+type redirect struct {
+	path      string
+	movedTo   string
+	deletedAt time.Time
+}
+
+// DetectRenames returns secrets in newSecrets which do not exist in Vault, but which are likely
+// renamed from a secret in Vault that does not exist in newSecrets. Secrets are matched by the
+// source ID recorded in Vault metadata or, with v.RenameDetection set to RenameContent, by
+// identical content. Content must match exactly one secret on both sides. Source IDs of AWS secrets
+// are ARNs, which never match after a rename, so only RenameContent detects renames in AWS sources.
+func (v *Vault) DetectRenames(newSecrets []*secret.Secret) []*move {
+	var moves []*move
+
+	if v.RenameDetection == RenameOff {
+		return moves
+	}
+
+	var added, removed []*secret.Secret
+	for _, new := range newSecrets {
+		if _, ok := v.keep[new.Name]; !ok && v.findSecret(new.Name) == nil {
+			added = append(added, new)
+		}
+	}
+	for _, cur := range v.Secrets {
+		if _, ok := v.keep[cur.Name]; !ok && !containsName(newSecrets, cur.Name) {
+			removed = append(removed, cur)
+		}
+	}
+
+	matched := make(map[*secret.Secret]bool)
+	for _, new := range added {
+		var from *secret.Secret
+
+		for _, cur := range removed {
+			if !matched[cur] && new.SourceID != "" && cur.Meta[secret.MetaSourceID] == new.SourceID {
+				from = cur
+				break
+			}
+		}
+
+		if from == nil && v.RenameDetection == RenameContent && len(new.Data) > 0 {
+			hash := helper.Hash(new.Data)
+			candidates := filterByHash(removed, hash)
+			if len(candidates) == 1 && len(filterByHash(added, hash)) == 1 && !matched[candidates[0]] {
+				from = candidates[0]
+			}
+		}
+
+		if from != nil {
+			matched[from] = true
+			moves = append(moves, &move{from: from, to: new})
+		}
+	}
+
+	return moves
+}
+
+// MoveSecret moves the secret m.from to the path of m.to, with all its live versions and its
+// metadata. If v.RenameRedirect is set, a tombstone pointing to the new path is left in the old
+// path. Afterwards m.from refers to the secret in its new path. With v.DryRun, nothing is written,
+// but m.from refers to the new path all the same.
+func (v *Vault) MoveSecret(m *move) error {
+	oldPath := m.from.Name
+	newPath := m.to.Name
+	fields := log.Fields{
+		"path":   newPath,
+		"from":   oldPath,
+		"system": "HashiCorp Vault",
+	}
+
+	if v.DryRun {
+		m.from.Name = newPath
+		return nil
+	}
+
+	current, _ := strconv.Atoi(m.from.Version)
+	versions := v.getSecretHistory(v.Context, oldPath, current, secret.HistoryAll)
+	versions = append(versions, &secret.Version{ID: m.from.Version, Data: m.from.Data})
+
+	cas := v.getCurrentVersion(newPath)
+	casBefore := cas
+	for _, version := range versions {
+		written, err := v.putSecretData(newPath, version.Data, cas, oldPath)
+		if err != nil {
+			log.WithFields(fields).WithError(err).Error("Unable to move secret")
+			return err
+		}
+		cas = written
+	}
+
+	moved := secret.New(newPath)
+	moved.SourceID = m.from.SourceID
+	moved.AddTags(m.from.Tags)
+	for key, val := range m.from.Meta {
+		moved.Meta[key] = val
+	}
+	err := v.putSecretMetadata(moved, casBefore == 0)
+	v.record(&syncEntry{Path: newPath, Action: ActionCreated, VersionBefore: casBefore, VersionAfter: cas})
+	if err != nil {
+		log.WithFields(fields).WithError(err).Error("Unable to move secret")
+		return err
+	}
+
+	if err := v.deleteMovedSecret(m.from, newPath, cas); err != nil {
+		log.WithFields(fields).WithError(err).Error("Unable to delete secret from its old path")
+	}
+
+	log.WithFields(fields).Info("Secret renamed in source system, moved with its history")
+
+	m.from.Name = newPath
+	m.from.Version = strconv.Itoa(cas)
+
+	return nil
+}
+
+// deleteMovedSecret deletes the secret cur, which has been moved to newPath as its version
+// newVersion, with all its versions. If v.RenameRedirect is set, a tombstone with only metadata
+// pointing to newPath is left behind.
+func (v *Vault) deleteMovedSecret(cur *secret.Secret, newPath string, newVersion int) error {
+	kv := v.Client.KVv2(v.Engine)
+
+	if err := kv.DeleteMetadata(v.Context, cur.Name); err != nil {
+		return err
+	}
+	v.recordAudit(&audit.Event{
+		Event:         audit.EventSecretDeleted,
+		Path:          cur.Name,
+		VersionBefore: cur.Version,
+		Hash:          v.hash(cur.Data),
+		Reason:        "moved to " + newPath,
+	})
+
+	version, _ := strconv.Atoi(cur.Version)
+	v.record(&syncEntry{
+		Path:           cur.Name,
+		Action:         ActionDeleted,
+		VersionBefore:  version,
+		MetadataBefore: cur.CustomMetadata(),
+		DataPath:       newPath,
+		DataVersion:    newVersion,
+	})
+
+	if !v.RenameRedirect {
+		return nil
+	}
+
+	metadata := vault.KVMetadataPutInput{
+		CustomMetadata: map[string]interface{}{
+			secret.MetaMovedTo:   newPath,
+			secret.MetaDeletedAt: time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+
+	if err := kv.PutMetadata(v.Context, cur.Name, metadata); err != nil {
+		return err
+	}
+	v.recordAudit(&audit.Event{
+		Event:  audit.EventMetadataWritten,
+		Path:   cur.Name,
+		Hash:   v.hash(metadata.CustomMetadata),
+		Reason: "redirect to " + newPath,
+	})
+
+	return nil
+}
+
+// PurgeRedirects deletes redirects found by readSecrets, which match v.Filter, left more than
+// v.TombstoneRetention ago. Redirects with no deletion time, such as those written by hand, are
+// kept. originPath no longer follows a move back through a purged redirect, so a secret moved
+// through it and read from this Vault as a source gets the source ID of a later path. Redirects
+// only matter for Vault sources: the source ID of an AWS secret is its ARN, which changes when it's
+// renamed, so renames in AWS sources are only detected with RENAME_DETECTION=content.
+func (v *Vault) PurgeRedirects() {
+	cutoff := time.Now().Add(-v.TombstoneRetention)
+
+	for _, r := range v.redirects {
+		if r.deletedAt.IsZero() || r.deletedAt.After(cutoff) || !v.Filter.Matches(secret.New(r.path)) {
+			continue
+		}
+
+		fields := log.Fields{
+			"path":   r.path,
+			"system": "HashiCorp Vault",
+		}
+
+		if err := v.Client.KVv2(v.Engine).DeleteMetadata(v.Context, r.path); err != nil {
+			log.WithFields(fields).WithError(err).Error("Unable to purge redirect")
+			continue
+		}
+		v.recordAudit(&audit.Event{
+			Event:  audit.EventSecretDeleted,
+			Path:   r.path,
+			Reason: "redirect to " + r.movedTo + " past retention",
+		})
+
+		log.WithFields(fields).Info("Purged redirect past retention")
+	}
+}
+
+// findSecret returns the secret with name from v.Secrets, or nil if not found.
+func (v *Vault) findSecret(name string) *secret.Secret {
+	for _, s := range v.Secrets {
+		if s.Name == name {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// originPath returns the path the secret in path was first created in, following redirects back
+// from path. This is the history of paths of a secret moved in Vault.
+func (v *Vault) originPath(path string) string {
+	seen := map[string]bool{path: true}
+
+	for moved := true; moved; {
+		moved = false
+		for _, r := range v.redirects {
+			if r.movedTo == path && !seen[r.path] {
+				path = r.path
+				seen[path] = true
+				moved = true
+				break
+			}
+		}
+	}
+
+	return path
+}
+
+// readRedirect returns the redirect in path, or nil if there is none. Redirects have metadata only,
+// so they are read only for paths with no data.
+func (v *Vault) readRedirect(path string) *redirect {
+	metadata, err := v.Client.KVv2(v.Engine).GetMetadata(v.Context, path)
+	if err != nil {
+		if !errors.Is(err, vault.ErrSecretNotFound) {
+			log.WithFields(log.Fields{
+				"path":   path,
+				"system": "HashiCorp Vault",
+			}).WithError(err).Error("Unable to read secret metadata")
+		}
+		return nil
+	}
+
+	movedTo, ok := metadata.CustomMetadata[secret.MetaMovedTo]
+	if !ok {
+		return nil
+	}
+
+	r := &redirect{path: path, movedTo: fmt.Sprintf("%v", movedTo)}
+	r.deletedAt, _ = time.Parse(time.RFC3339, fmt.Sprintf("%v", metadata.CustomMetadata[secret.MetaDeletedAt]))
+
+	return r
+}
+
+// containsName returns a boolean indicating whether secrets contain a secret with name.
+func containsName(secrets []*secret.Secret, name string) bool {
+	for _, s := range secrets {
+		if s.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterByHash returns secrets whose data has the given content hash.
+func filterByHash(secrets []*secret.Secret, hash string) []*secret.Secret {
+	var filtered []*secret.Secret
+
+	for _, s := range secrets {
+		if helper.Hash(s.Data) == hash {
+			filtered = append(filtered, s)
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,345 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync-secrets/pkg/audit"
+	"sync-secrets/pkg/secret"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// InternalPrefix is the path under the Secrets Engine where secret-sync keeps its own data. It
+	// is never synced nor cleaned.
+	InternalPrefix = ".secret-sync/"
+
+	keptDataPath   = InternalPrefix + "kept/"
+	syncRecordPath = InternalPrefix + "syncs/"
+
+	ActionCreated = "created"
+	ActionDeleted = "deleted"
+	ActionUpdated = "updated"
+)
+
+// A record of all changes made to Vault during a single sync, used to roll the sync back.
+type syncRecord struct {
+	ID      string       `json:"id"`
+	Time    time.Time    `json:"time"`
+	Entries []*syncEntry `json:"entries"`
+}
+
+// A change made to a single secret during a sync. Versions are KV versions in Vault, 0 meaning that
+// the secret did not exist. Secret values are never recorded: the data of a deleted secret is
+// referred to where it's still kept, in DataPath and DataVersion.
+type syncEntry struct {
+	Path           string                 `json:"path"`
+	Action         string                 `json:"action"`
+	VersionBefore  int                    `json:"version_before"`
+	VersionAfter   int                    `json:"version_after"`
+	MetadataBefore map[string]interface{} `json:"metadata_before,omitempty"`
+	DataPath       string                 `json:"data_path,omitempty"`    // Path of a deleted secret's data
+	DataVersion    int                    `json:"data_version,omitempty"` // Version in DataPath
+}
+
+// Rollback restores all secrets changed during the sync with syncID to their state before that
+// sync. Previous versions are written as new current versions and previous metadata is restored.
+// Secrets deleted during the sync are created again from their archived, moved, kept or soft
+// deleted versions, and secrets created during it are deleted (their latest version, so it can
+// still be undeleted). The rollback is recorded as a sync of its own,
+// so it can be rolled back as well.
+func (v *Vault) Rollback(syncID string) error {
+	record, err := v.readSyncRecord(syncID)
+	if err != nil {
+		return err
+	}
+
+	v.startSyncRecord()
+
+	var failed int
+	for i := len(record.Entries) - 1; i >= 0; i-- {
+		if err := v.rollbackEntry(record.Entries[i]); err != nil {
+			log.WithFields(log.Fields{
+				"path":   record.Entries[i].Path,
+				"system": "HashiCorp Vault",
+			}).WithError(err).Error("Unable to roll back secret")
+			failed++
+		}
+	}
+
+	v.saveSyncRecord()
+
+	if failed > 0 {
+		return fmt.Errorf("%d secrets could not be rolled back", failed)
+	}
+
+	log.WithFields(log.Fields{
+		"count":   len(record.Entries),
+		"sync-id": syncID,
+		"system":  "HashiCorp Vault",
+	}).Info("Successfully rolled back sync")
+
+	return nil
+}
+
+// keepData copies the current data of cur, which is to be destroyed, under the current sync in
+// keptDataPath, so that the deletion can be rolled back. Returns the path and version it's kept in,
+// or no path if changes are not recorded.
+func (v *Vault) keepData(cur *secret.Secret) (string, int, error) {
+	if v.syncRecord == nil {
+		return "", 0, nil
+	}
+
+	path := keptDataPath + v.syncRecord.ID + "/" + cur.Name
+	version, err := v.putSecretData(path, cur.Data, v.getCurrentVersion(path), cur.Name)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return path, version, nil
+}
+
+// pruneSyncRecords deletes all but the latest v.SyncRecords sync records, with the data kept for
+// their rollback. Sync IDs start with their time, so they are sorted from oldest to latest.
+func (v *Vault) pruneSyncRecords() {
+	kv := v.Client.KVv2(v.Engine)
+
+	paths, err := v.listSecretKeys(v.Context, syncRecordPath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":   syncRecordPath,
+			"system": "HashiCorp Vault",
+		}).WithError(err).Error("Unable to list sync records")
+		return
+	}
+	if len(paths) <= v.SyncRecords {
+		return
+	}
+
+	sort.Strings(paths)
+	for _, path := range paths[:len(paths)-v.SyncRecords] {
+		syncID := strings.TrimPrefix(path, syncRecordPath)
+		fields := log.Fields{
+			"sync-id": syncID,
+			"system":  "HashiCorp Vault",
+		}
+
+		kept, err := v.listSecretKeys(v.Context, keptDataPath+syncID+"/")
+		if err != nil {
+			log.WithFields(fields).WithError(err).Error("Unable to list data kept for rollback")
+			continue
+		}
+
+		var failed bool
+		for _, keptPath := range kept {
+			if err := kv.DeleteMetadata(v.Context, keptPath); err != nil {
+				log.WithFields(fields).WithError(err).Error("Unable to delete data kept for rollback")
+				failed = true
+				continue
+			}
+			v.recordAudit(&audit.Event{
+				Event:  audit.EventSecretDeleted,
+				Path:   keptPath,
+				Reason: "sync record past retention",
+			})
+		}
+
+		// The record is kept as long as it refers to any kept data
+		if failed {
+			continue
+		}
+		if err := kv.DeleteMetadata(v.Context, path); err != nil {
+			log.WithFields(fields).WithError(err).Error("Unable to delete sync record")
+			continue
+		}
+
+		log.WithFields(fields).Debug("Deleted sync record past retention")
+	}
+}
+
+// readSyncRecord returns the sync record with syncID.
+func (v *Vault) readSyncRecord(syncID string) (*syncRecord, error) {
+	vs, err := v.Client.KVv2(v.Engine).Get(v.Context, syncRecordPath+syncID)
+	if errors.Is(err, vault.ErrSecretNotFound) {
+		return nil, fmt.Errorf("no sync with ID %s found", syncID)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var record syncRecord
+	raw, _ := vs.Data["record"].(string)
+	if err := json.Unmarshal([]byte(raw), &record); err != nil {
+		return nil, fmt.Errorf("unable to parse sync record %s: %w", syncID, err)
+	}
+
+	return &record, nil
+}
+
+// record adds a change to the record of the current sync. Multiple changes to the same path are
+// merged into one entry, which has the state before the first change.
+func (v *Vault) record(entry *syncEntry) {
+	if v.syncRecord == nil {
+		return
+	}
+
+	for _, e := range v.syncRecord.Entries {
+		if e.Path == entry.Path {
+			e.VersionAfter = entry.VersionAfter
+			if entry.Action == ActionDeleted {
+				e.Action = ActionDeleted
+			}
+			return
+		}
+	}
+
+	v.syncRecord.Entries = append(v.syncRecord.Entries, entry)
+}
+
+// rollbackEntry restores the secret in entry to its state before the change.
+func (v *Vault) rollbackEntry(entry *syncEntry) error {
+	kv := v.Client.KVv2(v.Engine)
+	ctx := v.Context
+	cas := v.getCurrentVersion(entry.Path)
+
+	if entry.VersionBefore == 0 && entry.Action == ActionCreated {
+		if cas == 0 {
+			return nil
+		}
+
+		log.WithFields(log.Fields{
+			"path":   entry.Path,
+			"system": "HashiCorp Vault",
+		}).Info("Deleting secret created in the sync")
+
+		recorded := &syncEntry{
+			Path:          entry.Path,
+			Action:        ActionDeleted,
+			VersionBefore: cas,
+			VersionAfter:  cas,
+			DataPath:      entry.Path,
+			DataVersion:   cas,
+		}
+		if cur, _ := v.getSecret(entry.Path, secret.HistoryLatest); cur != nil {
+			recorded.MetadataBefore = cur.CustomMetadata()
+		}
+		v.record(recorded)
+
+		if err := kv.Delete(ctx, entry.Path); err != nil {
+			return err
+		}
+		v.recordAudit(&audit.Event{
+			Event:         audit.EventSecretDeleted,
+			Path:          entry.Path,
+			VersionBefore: strconv.Itoa(cas),
+			Reason:        "rollback of created secret",
+		})
+
+		return nil
+	}
+
+	data, err := v.dataBefore(entry)
+	if err != nil {
+		return err
+	}
+
+	cur, err := v.getSecret(entry.Path, secret.HistoryLatest)
+	if err != nil {
+		return err
+	}
+	recorded := &syncEntry{Path: entry.Path, Action: ActionUpdated, VersionBefore: cas, VersionAfter: cas}
+	if cur != nil {
+		recorded.MetadataBefore = cur.CustomMetadata()
+	} else if cas == 0 {
+		recorded.Action = ActionCreated
+	}
+
+	if data != nil {
+		written, err := v.putSecretData(entry.Path, data, cas, "rollback")
+		if err != nil {
+			return err
+		}
+		recorded.VersionAfter = written
+	}
+
+	s := secret.New(entry.Path)
+	s.AddCustomMetadata(entry.MetadataBefore)
+	err = v.putSecretMetadata(s, cas == 0)
+	v.record(recorded)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"path":    entry.Path,
+		"system":  "HashiCorp Vault",
+		"version": entry.VersionBefore,
+	}).Info("Secret rolled back")
+
+	return nil
+}
+
+// dataBefore returns the data the secret in entry had before the change, or nil if its data is to
+// be left as it is. A version soft deleted in its own path is undeleted instead, so nil is returned.
+func (v *Vault) dataBefore(entry *syncEntry) (map[string]interface{}, error) {
+	kv := v.Client.KVv2(v.Engine)
+	ctx := v.Context
+	path, version := entry.Path, entry.VersionBefore
+
+	switch {
+	case entry.Action == ActionDeleted && entry.DataPath == "":
+		return nil, errors.New("secret was destroyed, its data cannot be restored")
+	case entry.Action == ActionDeleted && entry.DataPath == entry.Path:
+		return nil, kv.Undelete(ctx, entry.Path, []int{entry.DataVersion})
+	case entry.Action == ActionDeleted:
+		path, version = entry.DataPath, entry.DataVersion
+	case entry.VersionBefore == entry.VersionAfter:
+		return nil, nil
+	}
+
+	vs, err := kv.GetVersion(ctx, path, version)
+	if err != nil {
+		return nil, fmt.Errorf("version %d of %s: %w", version, path, err)
+	}
+	if vs.Data == nil {
+		return nil, fmt.Errorf("version %d of %s is deleted", version, path)
+	}
+
+	return vs.Data, nil
+}
+
+// saveSyncRecord writes the record of the current sync to Vault, if anything was changed, and
+// prunes records past retention, see pruneSyncRecords.
+func (v *Vault) saveSyncRecord() {
+	if v.syncRecord == nil || len(v.syncRecord.Entries) == 0 {
+		return
+	}
+
+	fields := log.Fields{
+		"sync-id": v.syncRecord.ID,
+		"system":  "HashiCorp Vault",
+	}
+
+	raw, _ := json.Marshal(v.syncRecord)
+	data := map[string]interface{}{"record": string(raw)}
+
+	_, err := v.Client.KVv2(v.Engine).Put(v.Context, syncRecordPath+v.syncRecord.ID, data)
+	if err != nil {
+		log.WithFields(fields).WithError(err).Error("Unable to save sync record, rollback not possible")
+		return
+	}
+
+	log.WithFields(fields).Info("Sync recorded, roll back with: secret-sync rollback " + v.syncRecord.ID)
+
+	v.pruneSyncRecords()
+}
+
+// startSyncRecord starts recording changes made to Vault under v.SyncID.
+func (v *Vault) startSyncRecord() {
+	v.syncRecord = &syncRecord{ID: v.SyncID, Time: time.Now().UTC()}
+}
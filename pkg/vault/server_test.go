@@ -0,0 +1,369 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// vaultServer is an httptest.Server serving a KV version 2 Secrets Engine called DefaultEngine,
+// with as much of the Vault API as secret-sync uses. Reads of data in paths set with fail and
+// writes of metadata in paths set with failMetadata fail with a server error.
+type vaultServer struct {
+	*httptest.Server
+
+	lock            sync.Mutex
+	secrets         map[string]*kvSecret
+	failing         map[string]bool
+	failingMetadata map[string]bool
+	concurrent      map[string]int // Writes of data preceded by a concurrent write, see writeConcurrently
+}
+
+// A kvSecret with all its versions, version n at index n-1.
+type kvSecret struct {
+	versions    []*kvVersion
+	metadata    map[string]interface{}
+	casRequired bool
+}
+
+// A single kvVersion of a kvSecret.
+type kvVersion struct {
+	data      map[string]interface{}
+	created   time.Time
+	deleted   time.Time
+	destroyed bool
+}
+
+func newVaultServer(t *testing.T) *vaultServer {
+	t.Helper()
+
+	s := &vaultServer{
+		secrets:         make(map[string]*kvSecret),
+		failing:         make(map[string]bool),
+		failingMetadata: make(map[string]bool),
+		concurrent:      make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// newTestVault returns a Vault for server, configured with env variables as New, with the TEST_
+// prefix. Settings are set as such variables for the duration of the test.
+func newTestVault(t *testing.T, server *vaultServer, settings map[string]string) *Vault {
+	t.Helper()
+
+	t.Setenv("TEST_"+EnvAddr, server.URL)
+	t.Setenv("TEST_"+EnvToken, "test-token")
+	t.Setenv("TEST_"+EnvHashKey, "test-hash-key")
+	t.Setenv("TEST_"+vault.EnvVaultMaxRetries, "0")
+	for key, val := range settings {
+		t.Setenv("TEST_"+key, val)
+	}
+
+	return New("TEST_")
+}
+
+// data returns the current data of the secret in path, or nil if it does not exist or its current
+// version is deleted.
+func (s *vaultServer) data(path string) map[string]interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if kv := s.secrets[path]; kv != nil && len(kv.versions) > 0 {
+		if v := kv.versions[len(kv.versions)-1]; v.deleted.IsZero() && !v.destroyed {
+			return v.data
+		}
+	}
+
+	return nil
+}
+
+// fail makes reads of data in path fail.
+func (s *vaultServer) fail(path string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.failing[path] = true
+}
+
+// failMetadata makes writes of metadata in path fail.
+func (s *vaultServer) failMetadata(path string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.failingMetadata[path] = true
+}
+
+// put writes data as a new version of the secret in path, with metadata if not nil.
+func (s *vaultServer) put(path string, data, metadata map[string]interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	kv := s.secret(path)
+	kv.versions = append(kv.versions, &kvVersion{data: data, created: time.Now().UTC()})
+	if metadata != nil {
+		kv.metadata = metadata
+	}
+}
+
+// secret returns the secret in path, created if it does not exist.
+func (s *vaultServer) secret(path string) *kvSecret {
+	kv, ok := s.secrets[path]
+	if !ok {
+		kv = &kvSecret{metadata: make(map[string]interface{})}
+		s.secrets[path] = kv
+	}
+
+	return kv
+}
+
+// writeConcurrently makes the next n writes of data in path be preceded by a write of another
+// client, so that they fail on check-and-set.
+func (s *vaultServer) writeConcurrently(path string, n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.concurrent[path] = n
+}
+
+// serve serves a request to the Vault API.
+func (s *vaultServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var body map[string]interface{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	_ = decoder.Decode(&body)
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	switch {
+	case path == "sys/mounts":
+		respond(w, http.StatusOK, map[string]interface{}{
+			DefaultEngine + "/": map[string]interface{}{"type": "kv", "options": map[string]string{"version": "2"}},
+		})
+	case path == "auth/token/lookup-self":
+		respond(w, http.StatusOK, map[string]interface{}{"display_name": "token-test", "accessor": "test"})
+	case strings.HasPrefix(path, DefaultEngine+"/"):
+		op, key, _ := strings.Cut(strings.TrimPrefix(path, DefaultEngine+"/"), "/")
+		s.serveKV(w, r, op, key, body)
+	default:
+		respond(w, http.StatusNotFound, nil)
+	}
+}
+
+// serveKV serves a request to the Secrets Engine, with op such as "data" or "metadata", for the
+// secret in path.
+func (s *vaultServer) serveKV(w http.ResponseWriter, r *http.Request, op, path string, body map[string]interface{}) {
+	kv := s.secrets[path]
+	list := r.URL.Query().Get("list") == "true"
+
+	switch {
+	case op == "metadata" && list:
+		keys := s.list(path)
+		if len(keys) == 0 {
+			respond(w, http.StatusNotFound, nil)
+			return
+		}
+		respond(w, http.StatusOK, map[string]interface{}{"keys": keys})
+
+	case op == "metadata" && r.Method == http.MethodGet:
+		if kv == nil {
+			respond(w, http.StatusNotFound, nil)
+			return
+		}
+		respond(w, http.StatusOK, kv.fullMetadata())
+
+	case op == "metadata" && r.Method == http.MethodDelete:
+		delete(s.secrets, path)
+		respond(w, http.StatusNoContent, nil)
+
+	case op == "metadata":
+		if s.failingMetadata[path] {
+			respond(w, http.StatusInternalServerError, nil)
+			return
+		}
+		kv = s.secret(path)
+		kv.metadata, _ = body["custom_metadata"].(map[string]interface{})
+		kv.casRequired, _ = body["cas_required"].(bool)
+		respond(w, http.StatusNoContent, nil)
+
+	case op == "data" && r.Method == http.MethodGet:
+		if s.failing[path] {
+			respond(w, http.StatusInternalServerError, nil)
+			return
+		}
+		if kv == nil || len(kv.versions) == 0 {
+			respond(w, http.StatusNotFound, nil)
+			return
+		}
+
+		version := len(kv.versions)
+		if v, err := strconv.Atoi(r.URL.Query().Get("version")); err == nil && v > 0 {
+			version = v
+		}
+		if version > len(kv.versions) {
+			respond(w, http.StatusNotFound, nil)
+			return
+		}
+
+		v := kv.versions[version-1]
+		metadata := kv.versionMetadata(version)
+		metadata["custom_metadata"] = kv.metadata
+		if !v.deleted.IsZero() || v.destroyed {
+			respond(w, http.StatusNotFound, map[string]interface{}{"data": nil, "metadata": metadata})
+			return
+		}
+		respond(w, http.StatusOK, map[string]interface{}{"data": v.data, "metadata": metadata})
+
+	case op == "data" && r.Method == http.MethodDelete:
+		if kv != nil && len(kv.versions) > 0 {
+			kv.versions[len(kv.versions)-1].deleted = time.Now().UTC()
+		}
+		respond(w, http.StatusNoContent, nil)
+
+	case op == "data":
+		if s.concurrent[path] > 0 {
+			s.concurrent[path]--
+			kv = s.secret(path)
+			kv.versions = append(kv.versions, &kvVersion{
+				data:    map[string]interface{}{"password": "concurrent"},
+				created: time.Now().UTC(),
+			})
+		}
+
+		options, _ := body["options"].(map[string]interface{})
+		cas, hasCAS := options["cas"].(json.Number)
+		current := 0
+		if kv != nil {
+			current = len(kv.versions)
+		}
+		if (kv != nil && kv.casRequired && !hasCAS) || (hasCAS && cas.String() != strconv.Itoa(current)) {
+			respond(w, http.StatusBadRequest, map[string]interface{}{
+				"errors": []string{"check-and-set parameter did not match the current version"},
+			})
+			return
+		}
+
+		kv = s.secret(path)
+		data, _ := body["data"].(map[string]interface{})
+		kv.versions = append(kv.versions, &kvVersion{data: data, created: time.Now().UTC()})
+		metadata := kv.versionMetadata(len(kv.versions))
+		metadata["custom_metadata"] = kv.metadata
+		respond(w, http.StatusOK, metadata)
+
+	case op == "delete", op == "undelete", op == "destroy":
+		versions, _ := body["versions"].([]interface{})
+		for _, n := range versions {
+			version, _ := strconv.Atoi(n.(json.Number).String())
+			if kv == nil || version < 1 || version > len(kv.versions) {
+				continue
+			}
+
+			v := kv.versions[version-1]
+			switch op {
+			case "delete":
+				v.deleted = time.Now().UTC()
+			case "undelete":
+				v.deleted = time.Time{}
+			case "destroy":
+				v.destroyed = true
+			}
+		}
+		respond(w, http.StatusNoContent, nil)
+
+	default:
+		respond(w, http.StatusMethodNotAllowed, nil)
+	}
+}
+
+// list returns the keys of secrets directly under the folder prefix, with folders suffixed with a
+// slash. The client drops the slash of the folder.
+func (s *vaultServer) list(prefix string) []string {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	found := make(map[string]bool)
+	for path := range s.secrets {
+		if rest, ok := strings.CutPrefix(path, prefix); ok && rest != "" {
+			if i := strings.Index(rest, "/"); i >= 0 {
+				rest = rest[:i+1]
+			}
+			found[rest] = true
+		}
+	}
+
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// fullMetadata returns the metadata of kv, with that of all its versions.
+func (kv *kvSecret) fullMetadata() map[string]interface{} {
+	versions := make(map[string]interface{})
+	for i := range kv.versions {
+		versions[strconv.Itoa(i+1)] = kv.versionMetadata(i + 1)
+	}
+
+	return map[string]interface{}{
+		"current_version":      len(kv.versions),
+		"oldest_version":       0,
+		"max_versions":         0,
+		"cas_required":         kv.casRequired,
+		"delete_version_after": "0s",
+		"custom_metadata":      kv.metadata,
+		"versions":             versions,
+	}
+}
+
+// versionMetadata returns the metadata of the version of kv.
+func (kv *kvSecret) versionMetadata(version int) map[string]interface{} {
+	v := kv.versions[version-1]
+	deleted := ""
+	if !v.deleted.IsZero() {
+		deleted = v.deleted.Format(time.RFC3339Nano)
+	}
+
+	return map[string]interface{}{
+		"version":       version,
+		"created_time":  v.created.Format(time.RFC3339Nano),
+		"deletion_time": deleted,
+		"destroyed":     v.destroyed,
+	}
+}
+
+// respond writes a response of the Vault API with status and data, if not nil. Data with errors is
+// written as is.
+func respond(w http.ResponseWriter, status int, data map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	switch {
+	case data == nil && status >= http.StatusBadRequest:
+		data = map[string]interface{}{"errors": []string{http.StatusText(status)}}
+	case data == nil:
+		return
+	case data["errors"] == nil:
+		data = map[string]interface{}{"data": data}
+	}
+
+	var b bytes.Buffer
+	_ = json.NewEncoder(&b).Encode(data)
+	_, _ = w.Write(b.Bytes())
+}
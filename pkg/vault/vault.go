@@ -2,9 +2,20 @@ package vault
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
 	"strings"
+	"sync-secrets/pkg/audit"
 	"sync-secrets/pkg/helper"
+	"sync-secrets/pkg/metrics"
+	"sync-secrets/pkg/redact"
+	"sync-secrets/pkg/report"
 	"sync-secrets/pkg/secret"
+	"sync-secrets/pkg/tags"
+	"sync-secrets/pkg/tracing"
+	"time"
 
 	vault "github.com/hashicorp/vault/api"
 	auth "github.com/hashicorp/vault/api/auth/kubernetes"
@@ -12,24 +23,97 @@ import (
 )
 
 const (
-	EnvAddr     = "VAULT_ADDR"
-	EnvKubeRole = "VAULT_KUBERNETES_ROLE"
-	EnvEngine   = "VAULT_SECRETS_ENGINE"
-	EnvToken    = "VAULT_TOKEN"
+	EnvAddr               = "VAULT_ADDR"
+	EnvCASRequired        = "VAULT_CAS_REQUIRED"
+	EnvDeleteStrategy     = "DELETE_STRATEGY"
+	EnvDriftPolicy        = "DRIFT_POLICY"
+	EnvKubeRole           = "VAULT_KUBERNETES_ROLE"
+	EnvProductionLeaks    = "PRODUCTION_LEAKS"
+	EnvEngine             = "VAULT_SECRETS_ENGINE"
+	EnvHashKey            = "HASH_KEY"
+	EnvHistory            = "SYNC_HISTORY"
+	EnvRenameDetection    = "RENAME_DETECTION"
+	EnvRenameRedirect     = "RENAME_REDIRECT"
+	EnvSyncRecords        = "SYNC_RECORDS"
+	EnvTombstonePrefix    = "TOMBSTONE_PREFIX"
+	EnvTombstoneRetention = "TOMBSTONE_RETENTION"
+	EnvToken              = "VAULT_TOKEN"
 
-	DefaultEngine = "secrets"
+	DefaultEngine             = "secrets"
+	DefaultSyncRecords        = 100
+	DefaultTombstonePrefix    = InternalPrefix + "tombstones/"
+	DefaultTombstoneRetention = 30 * 24 * time.Hour
+
+	DeleteArchive    = "archive"     // Move removed secrets under v.TombstonePrefix
+	DeleteDestroy    = "destroy"     // Delete removed secrets with all their versions
+	DeletePurgeAfter = "purge-after" // Archive, and destroy archived secrets after retention
+	DeleteSoft       = "soft"        // Delete the latest version of removed secrets
+
+	DriftFail      = "fail"      // Abort the sync before writing anything
+	DriftOverwrite = "overwrite" // Overwrite drifted secrets with the source value
+	DriftSkip      = "skip"      // Leave drifted secrets untouched
+
+	LeaksDelete = "delete" // Delete production secrets found in a non-production Vault
+	LeaksKeep   = "keep"   // Keep production secrets found in a non-production Vault, and flag them
+
+	// Number of times a write is planned and attempted when it fails on check-and-set
+	maxCASAttempts = 3
 )
 
+// MetadataLimits are the limits of Vault on custom metadata. Keys managed by secret-sync, see
+// secret.MetaKeys, count towards the number of keys.
+var MetadataLimits = tags.Limits{
+	MaxKeys:        64 - len(secret.MetaKeys),
+	MaxKeyLength:   128,
+	MaxValueLength: 512,
+}
+
+// errConflict is returned when a write is rejected because the destination secret was changed
+// after it was read.
+var errConflict = errors.New("secret was changed concurrently")
+
 type Vault struct {
 	Address string
 	Auth    struct {
 		Token          string
 		KubernetesRole string
 	}
-	Config  *vault.Config
-	Client  *vault.Client
-	Engine  string
-	Secrets []*secret.Secret
+	CASRequired        bool
+	Config             *vault.Config
+	Context            context.Context // Parent of traced calls, such as the span of a sync job
+	Client             *vault.Client
+	DeleteStrategy     string
+	DriftPolicy        string
+	DryRun             bool // Changes are planned and reported, but nothing is written
+	Engine             string
+	Filter             *secret.Filter
+	HashKey            []byte // Key of content hashes, see hashKey
+	History            int
+	ProductionLeaks    string // What to do with production secrets blocked from Vault but found in it
+	RenameDetection    string
+	RenameRedirect     bool
+	Secrets            []*secret.Secret
+	SyncID             string
+	SyncRecords        int         // Number of sync records kept for rollback, see pruneSyncRecords
+	TagRules           *tags.Rules // Rules of custom metadata written, see CheckSecrets
+	TombstonePrefix    string
+	TombstoneRetention time.Duration
+
+	actor      string            // Token changes are made with, see tokenIdentity
+	drifted    map[string]bool   // Paths changed outside of secret-sync, see DetectDrift
+	keep       map[string]string // Paths left untouched during sync, with the reason
+	redirects  []*redirect       // Redirects found by readSecrets
+	syncRecord *syncRecord       // Changes made during the current sync
+}
+
+// An action planned for a single secret: versions of data to write and whether to write metadata.
+type action struct {
+	secret   *secret.Secret // Secret from the source system
+	current  *secret.Secret // Secret currently in Vault, or nil if it does not exist
+	cas      int            // Current version of the secret in Vault, 0 if it does not exist
+	versions []*secret.Version
+	metadata bool
+	reason   string // Reason recorded in the sync report, if any
 }
 
 // New returns a new Vault struct. Configurations are read from environment variables. The envPrefix
@@ -40,7 +124,7 @@ type Vault struct {
 // For example, New("SOURCE_") will first get value from "SOURCE_VAULT_ADDR". If not found, tries to
 // get value from "VAULT_ADDR".
 func New(envPrefix string) *Vault {
-	v := Vault{}
+	v := Vault{Context: context.Background()}
 	fields := log.Fields{"system": "HashiCorp Vault"}
 
 	if e := helper.Getenv(envPrefix, EnvAddr); e != "" {
@@ -68,7 +152,102 @@ func New(envPrefix string) *Vault {
 	}
 	fields["secrets-engine"] = v.Engine
 
-	config := vault.DefaultConfig()
+	if e := helper.Getenv(envPrefix, EnvCASRequired); e != "" {
+		casRequired, err := strconv.ParseBool(e)
+		if err != nil {
+			log.WithFields(fields).WithError(err).Fatalf("Invalid value for %s", envPrefix+EnvCASRequired)
+		}
+		v.CASRequired = casRequired
+	}
+
+	switch e := helper.Getenv(envPrefix, EnvDriftPolicy); e {
+	case "":
+		v.DriftPolicy = DriftOverwrite
+	case DriftFail, DriftOverwrite, DriftSkip:
+		v.DriftPolicy = e
+	default:
+		log.WithFields(fields).Fatalf("%s should be one of: %s, %s, %s", envPrefix+EnvDriftPolicy,
+			DriftOverwrite, DriftSkip, DriftFail)
+	}
+
+	switch e := helper.Getenv(envPrefix, EnvDeleteStrategy); e {
+	case "":
+		v.DeleteStrategy = DeleteDestroy
+	case DeleteArchive, DeleteDestroy, DeletePurgeAfter, DeleteSoft:
+		v.DeleteStrategy = e
+	default:
+		log.WithFields(fields).Fatalf("%s should be one of: %s, %s, %s, %s", envPrefix+EnvDeleteStrategy,
+			DeleteDestroy, DeleteSoft, DeleteArchive, DeletePurgeAfter)
+	}
+
+	switch e := helper.Getenv(envPrefix, EnvProductionLeaks); e {
+	case "":
+		v.ProductionLeaks = LeaksKeep
+	case LeaksDelete, LeaksKeep:
+		v.ProductionLeaks = e
+	default:
+		log.WithFields(fields).Fatalf("%s should be one of: %s, %s", envPrefix+EnvProductionLeaks,
+			LeaksKeep, LeaksDelete)
+	}
+
+	switch e := helper.Getenv(envPrefix, EnvRenameDetection); e {
+	case "":
+		v.RenameDetection = RenameID
+	case RenameContent, RenameID, RenameOff:
+		v.RenameDetection = e
+	default:
+		log.WithFields(fields).Fatalf("%s should be one of: %s, %s, %s", envPrefix+EnvRenameDetection,
+			RenameContent, RenameID, RenameOff)
+	}
+
+	if e := helper.Getenv(envPrefix, EnvRenameRedirect); e != "" {
+		redirect, err := strconv.ParseBool(e)
+		if err != nil {
+			log.WithFields(fields).WithError(err).Fatalf("Invalid value for %s", envPrefix+EnvRenameRedirect)
+		}
+		v.RenameRedirect = redirect
+	}
+
+	if e := helper.Getenv(envPrefix, EnvSyncRecords); e != "" {
+		records, err := strconv.Atoi(e)
+		if err != nil || records < 1 {
+			log.WithFields(fields).Fatalf("%s should be a positive number", envPrefix+EnvSyncRecords)
+		}
+		v.SyncRecords = records
+	} else {
+		v.SyncRecords = DefaultSyncRecords
+	}
+
+	if e := helper.Getenv(envPrefix, EnvTombstonePrefix); e != "" {
+		v.TombstonePrefix = strings.TrimSuffix(strings.TrimPrefix(e, "/"), "/") + "/"
+	} else {
+		v.TombstonePrefix = DefaultTombstonePrefix
+	}
+
+	if e := helper.Getenv(envPrefix, EnvTombstoneRetention); e != "" {
+		retention, err := parseDurationDays(e)
+		if err != nil {
+			log.WithFields(fields).WithError(err).Fatalf("Invalid value for %s", envPrefix+EnvTombstoneRetention)
+		}
+		v.TombstoneRetention = retention
+	} else {
+		v.TombstoneRetention = DefaultTombstoneRetention
+	}
+
+	if e := helper.Getenv(envPrefix, EnvHashKey); e != "" {
+		v.HashKey = []byte(e)
+	}
+
+	history, err := secret.ParseHistory(helper.Getenv(envPrefix, EnvHistory))
+	if err != nil {
+		log.WithFields(fields).WithError(err).Fatalf("Invalid value for %s", envPrefix+EnvHistory)
+	}
+	v.History = history
+
+	config, err := newConfig(envPrefix)
+	if err != nil {
+		log.WithFields(fields).WithError(err).Fatal("Invalid Vault client configuration")
+	}
 	config.Address = v.Address
 
 	log.WithFields(fields).Infof("Connecting to HashiCorp Vault")
@@ -101,17 +280,12 @@ func New(envPrefix string) *Vault {
 	v.Config = config
 	v.Client = client
 
-	if !v.hasEngine(v.Engine) {
-		log.WithFields(fields).Infof("Secrets Engine %s does not exist", v.Engine)
-		v.createKvEngine(v.Engine)
-	}
-
 	return &v
 }
 
 // CleanRemovedSecrets compares each secret in newSecrets and curSecrets. If a secret in the latter
 // does not exist in the prior, it is considered removed from the source system and will be deleted
-// from Vault as well.
+// from Vault as well. Secrets in v.keep are left untouched.
 func (v *Vault) CleanRemovedSecrets(newSecrets []*secret.Secret) {
 	var removedSecrets uint32
 	var secretFound bool
@@ -126,13 +300,29 @@ func (v *Vault) CleanRemovedSecrets(newSecrets []*secret.Secret) {
 			}
 		}
 
+		if reason, ok := v.keep[cur.Name]; ok {
+			if !secretFound && cur.Err != nil {
+				report.Record(cur.Name, report.ActionFailed, "", cur.Err)
+			} else if !secretFound {
+				report.Record(cur.Name, report.ActionSkipped, reason, nil)
+			}
+			continue
+		}
+
 		if !secretFound {
 			log.WithFields(log.Fields{
 				"path":   cur.Name,
 				"system": "HashiCorp Vault",
 			}).Info("Secret removed from source system, removing also from Vault")
-			v.Client.KVv2(v.Engine).DeleteMetadata(context.Background(), cur.Name)
-			removedSecrets++
+			if err := v.deleteSecret(cur, "removed from source, "+v.DeleteStrategy); err != nil {
+				report.Record(cur.Name, report.ActionFailed, "removed from source", err)
+			} else {
+				report.Record(cur.Name, report.ActionDeleted, "removed from source", nil)
+				if v.DryRun {
+					report.RecordKeys(cur.Name, secret.DiffKeys(nil, cur))
+				}
+				removedSecrets++
+			}
 		}
 	}
 
@@ -144,31 +334,140 @@ func (v *Vault) CleanRemovedSecrets(newSecrets []*secret.Secret) {
 	}
 }
 
-// GetSecrets returns a Slice with all secrets from Vault which belong to env.
-func (v *Vault) GetSecrets(env *secret.Environment) []*secret.Secret {
-	if env == nil {
-		env = &secret.GlobalEnv
+// PurgeTombstones deletes secrets archived under v.TombstonePrefix more than v.TombstoneRetention
+// ago, with all their versions.
+func (v *Vault) PurgeTombstones() {
+	var purged uint32
+	cutoff := time.Now().Add(-v.TombstoneRetention)
+
+	// Having no tombstones is the usual case, so it's not warned about
+	paths, err := v.listSecretKeys(v.Context, v.TombstonePrefix)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":   v.TombstonePrefix,
+			"system": "HashiCorp Vault",
+		}).WithError(err).Error("Unable to list tombstones")
+		return
 	}
 
-	var secrets []*secret.Secret
+	for _, path := range paths {
+		fields := log.Fields{
+			"path":   path,
+			"system": "HashiCorp Vault",
+		}
 
-	for _, key := range v.getSecretKeys("") {
-		s := v.getSecret(key)
-		s.SetEnv()
+		metadata, err := v.Client.KVv2(v.Engine).GetMetadata(v.Context, path)
+		if err != nil {
+			log.WithFields(fields).WithError(err).Error("Unable to read tombstone metadata")
+			continue
+		}
 
-		if s.BelongsToEnv(env) {
-			if !env.IsGroup {
-				s.TrimNameEnv()
+		deletedAt, err := time.Parse(time.RFC3339, fmt.Sprintf("%v", metadata.CustomMetadata[secret.MetaDeletedAt]))
+		if err != nil || deletedAt.After(cutoff) {
+			continue
+		}
+
+		if err := v.Client.KVv2(v.Engine).DeleteMetadata(v.Context, path); err != nil {
+			log.WithFields(fields).WithError(err).Error("Unable to purge tombstone")
+			continue
+		}
+		v.recordAudit(&audit.Event{
+			Event:         audit.EventSecretDeleted,
+			Path:          path,
+			VersionBefore: strconv.Itoa(metadata.CurrentVersion),
+			Reason:        "tombstone past retention",
+		})
+
+		log.WithFields(fields).Info("Purged tombstone past retention")
+		purged++
+	}
+
+	if purged > 0 {
+		log.WithFields(log.Fields{
+			"count":  purged,
+			"system": "HashiCorp Vault",
+		}).Info("Successfully purged tombstones")
+	}
+}
+
+// DetectDrift compares data of each secret in v.Secrets with the content hash recorded when it was
+// last synced. Secrets changed since, directly in Vault rather than in the source system, are
+// reported and returned. Secrets with no recorded hash, or a hash recorded before hashes were
+// keyed, are never considered drifted.
+func (v *Vault) DetectDrift() []*secret.Secret {
+	var drifted []*secret.Secret
+
+	for _, cur := range v.Secrets {
+		hash, ok := cur.Meta[secret.MetaContentHash]
+		if !ok || !strings.HasPrefix(hash, helper.HMACPrefix) || hash == v.hash(cur.Data) {
+			continue
+		}
+
+		drifted = append(drifted, cur)
+		log.WithFields(log.Fields{
+			"event":  "drift",
+			"path":   cur.Name,
+			"policy": v.DriftPolicy,
+			"system": "HashiCorp Vault",
+		}).Warn("Secret changed outside of secret-sync since last sync")
+		metrics.Add("secret_sync_drifted_secrets_total", "Secrets found changed outside of secret-sync.",
+			nil, 1)
+	}
+
+	metrics.Set("secret_sync_drifted_secrets", "Number of secrets changed outside of secret-sync.",
+		nil, float64(len(drifted)))
+
+	return drifted
+}
+
+// CheckSecrets maps the tags of new secrets with v.TagRules, and fails secrets exceeding the limits of
+// Vault on custom metadata.
+func (v *Vault) CheckSecrets(newSecrets []*secret.Secret) {
+	v.TagRules.Apply(newSecrets)
+
+	for _, new := range newSecrets {
+		if new.Err == nil {
+			if err := MetadataLimits.Validate(new.Tags); err != nil {
+				new.Fail(fmt.Errorf("custom metadata: %w", err))
 			}
+		}
+	}
+}
+
+// Identity returns the address and secrets engine of v.
+func (v *Vault) Identity() string {
+	return strings.TrimSuffix(v.Address, "/") + "/" + v.Engine
+}
+
+// GetAllSecrets returns a Slice with the latest versions of all secrets in Vault, whatever their
+// environment and v.Filter.
+func (v *Vault) GetAllSecrets() []*secret.Secret {
+	var secrets []*secret.Secret
+
+	ctx, span := tracing.StartBackend(v.Context, "secrets.list", "vault", "")
+	keys := v.getSecretKeys(ctx, "")
+	tracing.End(span, nil)
+
+	for _, key := range keys {
+		if s, _ := v.getSecret(key, secret.HistoryLatest); s != nil {
+			s.SetEnv()
 			secrets = append(secrets, s)
 		}
 	}
 
-	log.WithFields(log.Fields{
-		"count":  len(secrets),
-		"system": "HashiCorp Vault",
-	}).Info("Secrets successfully read")
+	return secrets
+}
+
+// GetCurrentSecrets returns a Slice with the latest versions of all secrets currently in Vault,
+// as they are compared to new secrets.
+func (v *Vault) GetCurrentSecrets() []*secret.Secret {
+	return v.readSecrets(nil, secret.HistoryLatest)
+}
 
+// GetSecrets returns a Slice with all secrets from Vault which belong to env. Tags are as in Vault,
+// tag rules are applied by the destination in CheckSecrets.
+func (v *Vault) GetSecrets(env *secret.Environment) []*secret.Secret {
+	secrets := v.readSecrets(env, v.History)
 	v.Secrets = append(v.Secrets, secrets...)
 
 	return v.Secrets
@@ -177,36 +476,99 @@ func (v *Vault) GetSecrets(env *secret.Environment) []*secret.Secret {
 // UpdateChangedSecrets compares each secret in newSecrets and curSecrets. If a secret has changed,
 // data or metadata, it's updated to Vault. If a secret in curSecrets has been removed in
 // newSecrets, it's removed from Vault.
+//
+// Any versions in new secret's History which have not been synced yet are written before the
+// current version, in order. Source version of the last written version is recorded in the
+// metadata, so the same versions are not written again on the next run.
+//
+// Data is written with check-and-set against the version read earlier. If the secret has been
+// changed in between, it's read again and the action is planned again. Such secrets are logged as
+// conflicts, and reported with a conflict as the reason. Secrets in v.keep are left untouched.
 func (v *Vault) UpdateChangedSecrets(newSecrets []*secret.Secret) {
 	var updatedSecrets uint32
-	var updateData bool
-	var updateTags bool
+	var conflicts uint32
 
 	for _, new := range newSecrets {
-		updateData = true
-		updateTags = true
+		cur := v.findSecret(new.Name)
 
-		for _, cur := range v.Secrets {
-			if new.EqualName(cur) {
-				updateData = !new.EqualData(cur)
-				updateTags = !new.EqualTags(cur)
-				break
+		if reason, ok := v.keep[new.Name]; ok {
+			log.WithFields(log.Fields{
+				"path":   new.Name,
+				"reason": reason,
+				"system": "HashiCorp Vault",
+			}).Info("Skipping secret")
+
+			switch {
+			case cur != nil && cur.Err == nil && errors.Is(new.Err, secret.ErrProduction):
+				v.handleLeak(new, cur)
+			case new.Err != nil:
+				report.Record(new.Name, report.ActionFailed, "", new.Err)
+			case cur != nil && cur.Err != nil:
+				report.Record(new.Name, report.ActionFailed, "", cur.Err)
+			default:
+				report.Record(new.Name, report.ActionSkipped, reason, nil)
 			}
+			continue
 		}
 
-		if updateData {
-			v.putSecretData(new)
-		}
+		var a *action
+		var err error
+		for attempt := 1; ; attempt++ {
+			_, span := tracing.StartBackend(v.Context, "secret.compare", "vault", new.Name)
+			a = planAction(new, cur, v.hash(new.Data))
+			if cur == nil {
+				// The secret may still exist with its current version deleted
+				a.cas = v.getCurrentVersion(new.Name)
+			}
+			switch {
+			case attempt > 1:
+				a.reason = fmt.Sprintf("conflict, attempt %d of %d", attempt, maxCASAttempts)
+			case v.drifted[new.Name]:
+				a.reason = "drifted, overwritten"
+			}
+			tracing.End(span, nil)
+
+			err = v.applyAction(a)
 
-		if updateTags {
-			v.putSecretMetadata(new)
+			if err == nil && a.changed() {
+				updatedSecrets++
+			}
+
+			if !errors.Is(err, errConflict) {
+				break
+			}
+
+			fields := log.Fields{
+				"path":   new.Name,
+				"system": "HashiCorp Vault",
+			}
+
+			if attempt == 1 {
+				conflicts++
+			}
+
+			if attempt == maxCASAttempts {
+				log.WithFields(fields).Errorf("Secret changed concurrently %d times, giving up", attempt)
+				break
+			}
+
+			log.WithFields(fields).Warn("Secret changed concurrently, reading it again")
+			cur, _ = v.getSecret(new.Name, secret.HistoryLatest)
 		}
 
-		if updateData || updateTags {
-			updatedSecrets++
+		reportAction(a, err)
+		if v.DryRun && err == nil {
+			report.RecordKeys(new.Name, secret.DiffKeys(new, cur))
 		}
 	}
 
+	if conflicts > 0 {
+		log.WithFields(log.Fields{
+			"count":  conflicts,
+			"system": "HashiCorp Vault",
+		}).Warn("Secrets changed concurrently during sync")
+	}
+
 	if updatedSecrets > 0 {
 		log.WithFields(log.Fields{
 			"count":  updatedSecrets,
@@ -220,11 +582,173 @@ func (v *Vault) UpdateChangedSecrets(newSecrets []*secret.Secret) {
 }
 
 // UpdateSecrets compares new secrets to those currently in Vault, updating any changed and cleaning
-// any removed.
-func (v *Vault) UpdateSecrets(newSecrets []*secret.Secret) {
-	v.GetSecrets(nil)
+// any removed. Secrets changed directly in Vault since last sync are handled according to
+// v.DriftPolicy. Secrets are checked with CheckSecrets first, and failed secrets are left untouched.
+// Returns an error, with nothing written, if secrets have drifted and v.DriftPolicy is DriftFail.
+//
+// All changes are recorded under v.SyncID, so that they can be rolled back with Rollback. With
+// v.DryRun, the changes are only reported, as they would be made.
+func (v *Vault) UpdateSecrets(newSecrets []*secret.Secret) error {
+	if v.SyncID == "" {
+		v.SyncID = helper.NewID()
+	}
+
+	v.Secrets = nil
+	v.drifted = make(map[string]bool)
+	v.keep = make(map[string]string)
+
+	if !v.hasEngine(v.Engine) {
+		log.WithFields(log.Fields{
+			"secrets-engine": v.Engine,
+			"system":         "HashiCorp Vault",
+		}).Infof("Secrets Engine %s does not exist", v.Engine)
+		if !v.DryRun {
+			v.createKvEngine(v.Engine)
+		}
+	} else {
+		v.Secrets = v.GetCurrentSecrets()
+	}
+
+	v.CheckSecrets(newSecrets)
+	for _, new := range newSecrets {
+		if new.Err != nil {
+			v.keep[new.Name] = new.Err.Error()
+		}
+	}
+	for _, cur := range v.Secrets {
+		if cur.Err != nil {
+			v.keep[cur.Name] = cur.Err.Error()
+		}
+	}
+
+	drifted := v.DetectDrift()
+	if len(drifted) > 0 {
+		var paths []string
+		for _, s := range drifted {
+			paths = append(paths, s.Name)
+			v.drifted[s.Name] = true
+			if v.DriftPolicy == DriftSkip {
+				v.keep[s.Name] = "drifted"
+			}
+		}
+
+		fields := log.Fields{
+			"count":  len(drifted),
+			"paths":  strings.Join(paths, ","),
+			"policy": v.DriftPolicy,
+			"system": "HashiCorp Vault",
+		}
+
+		if v.DriftPolicy == DriftFail && v.DryRun {
+			log.WithFields(fields).Error("Secrets changed outside of secret-sync, sync would be refused")
+			for _, s := range v.Secrets {
+				v.keep[s.Name] = "sync refused, secrets drifted"
+			}
+		} else if v.DriftPolicy == DriftFail {
+			err := fmt.Errorf("%d secrets changed outside of secret-sync", len(drifted))
+			log.WithFields(fields).Error("Secrets changed outside of secret-sync, refusing to sync")
+			for _, s := range drifted {
+				report.Record(s.Name, report.ActionFailed, "drifted, sync refused", err)
+			}
+			return fmt.Errorf("sync refused: %w", err)
+		}
+		log.WithFields(fields).Warn("Secrets changed outside of secret-sync")
+	}
+
+	if !v.DryRun {
+		v.startSyncRecord()
+		defer v.saveSyncRecord()
+	}
+
+	for _, m := range v.DetectRenames(newSecrets) {
+		// MoveSecret renames m.from, so the old path is recorded before
+		oldPath := m.from.Name
+		if err := v.MoveSecret(m); err != nil {
+			v.keep[oldPath] = "move failed"
+			continue
+		}
+
+		report.Record(oldPath, report.ActionMoved, "moved to "+m.to.Name, nil)
+		metrics.Add("secret_sync_moved_secrets_total",
+			"Number of secrets moved after being renamed in the source.", nil, 1)
+	}
+
 	v.UpdateChangedSecrets(newSecrets)
 	v.CleanRemovedSecrets(newSecrets)
+
+	if v.DeleteStrategy == DeletePurgeAfter && !v.DryRun {
+		v.PurgeTombstones()
+	}
+	if !v.DryRun {
+		v.PurgeRedirects()
+	}
+
+	return nil
+}
+
+// Validate returns an error if the token of the client is not valid. No secrets are read.
+func (v *Vault) Validate() error {
+	if _, err := v.Client.Auth().Token().LookupSelf(); err != nil {
+		return fmt.Errorf("token lookup failed: %w", err)
+	}
+
+	if !v.hasEngine(v.Engine) {
+		log.WithFields(log.Fields{
+			"secrets-engine": v.Engine,
+			"system":         "HashiCorp Vault",
+		}).Warnf("Secrets Engine %s does not exist, it will be created on sync", v.Engine)
+	}
+
+	return nil
+}
+
+// applyAction writes the versions and metadata planned in a to Vault, unless v.DryRun. Returns
+// errConflict if the secret was changed after a.current was read.
+func (v *Vault) applyAction(a *action) error {
+	if v.DryRun {
+		return nil
+	}
+
+	cas := a.cas
+	entry := syncEntry{Path: a.secret.Name, Action: ActionUpdated, VersionBefore: a.cas}
+	if a.current != nil {
+		entry.MetadataBefore = a.current.CustomMetadata()
+	} else if a.cas == 0 {
+		entry.Action = ActionCreated
+	}
+
+	for _, version := range a.versions {
+		written, err := v.putSecretData(a.secret.Name, version.Data, cas,
+			audit.SourceRef(a.secret.SourceID, version.ID))
+		if err != nil {
+			if cas != a.cas {
+				entry.VersionAfter = cas
+				v.record(&entry)
+			}
+			return err
+		}
+		cas = written
+	}
+
+	if a.metadata {
+		a.secret.Meta[secret.MetaContentHash] = v.hash(a.secret.Data)
+		a.secret.Meta[secret.MetaSourceID] = a.secret.SourceID
+		a.secret.Meta[secret.MetaSourceVersion] = a.secret.Version
+		if err := v.putSecretMetadata(a.secret, a.cas == 0); err != nil {
+			if cas != a.cas {
+				entry.VersionAfter = cas
+				v.record(&entry)
+			}
+			return err
+		}
+	}
+
+	if a.changed() {
+		entry.VersionAfter = cas
+		v.record(&entry)
+	}
+
+	return nil
 }
 
 // createKvEngine creates a key-value Secrets Engine to Vault with given name.
@@ -248,27 +772,207 @@ func (v *Vault) createKvEngine(name string) {
 	}
 }
 
-// getSecret returns data and metadata for secret in path.
-func (v *Vault) getSecret(path string) *secret.Secret {
-	secret := secret.New(path)
+// deleteSecret deletes the secret cur from Vault according to v.DeleteStrategy:
+//   - destroy deletes the secret with all its versions. Its current data is kept for rollback in
+//     the record of the sync, see keepData.
+//   - soft deletes the latest version only, so it can be undeleted.
+//   - archive and purge-after move the secret under v.TombstonePrefix, recording the deletion time
+//     and original path in its metadata.
+//
+// The reason is recorded in the audit log. With v.DryRun, nothing is deleted.
+func (v *Vault) deleteSecret(cur *secret.Secret, reason string) error {
+	if v.DryRun {
+		return nil
+	}
+
+	var err error
+	kv := v.Client.KVv2(v.Engine)
+	ctx, span := tracing.StartBackend(v.Context, "secret.delete", "vault", cur.Name)
+	version, _ := strconv.Atoi(cur.Version)
+	entry := &syncEntry{
+		Path:           cur.Name,
+		Action:         ActionDeleted,
+		VersionBefore:  version,
+		MetadataBefore: cur.CustomMetadata(),
+	}
+
+	switch v.DeleteStrategy {
+	case DeleteSoft:
+		err = kv.Delete(ctx, cur.Name)
+		entry.DataPath, entry.DataVersion = cur.Name, version
+	case DeleteArchive, DeletePurgeAfter:
+		if entry.DataVersion, err = v.archiveSecret(cur); err == nil {
+			entry.DataPath = v.TombstonePrefix + cur.Name
+			err = kv.DeleteMetadata(ctx, cur.Name)
+		}
+	default:
+		if entry.DataPath, entry.DataVersion, err = v.keepData(cur); err == nil {
+			err = kv.DeleteMetadata(ctx, cur.Name)
+		}
+	}
+	tracing.End(span, err)
 
-	vs, err := v.Client.KVv2(v.Engine).Get(context.Background(), secret.Name)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"path":   path,
-			"system": "HashiCorp Vault",
-		}).WithError(err).Error("Unable to read secret data")
+			"path":     cur.Name,
+			"strategy": v.DeleteStrategy,
+			"system":   "HashiCorp Vault",
+		}).WithError(err).Error("Unable to delete secret")
+		return err
 	}
 
-	secret.AddData(vs.Data)
-	secret.AddTags(vs.CustomMetadata)
+	v.record(entry)
+	v.recordAudit(&audit.Event{
+		Event:         audit.EventSecretDeleted,
+		Path:          cur.Name,
+		VersionBefore: cur.Version,
+		Hash:          v.hash(cur.Data),
+		Reason:        reason,
+	})
 
-	return secret
+	return nil
 }
 
-// getSecretKeys returns a list of secret keys under given path.
-func (v *Vault) getSecretKeys(path string) []string {
-	var keys []string
+// archiveSecret copies cur under v.TombstonePrefix, with all its live versions and its metadata, as
+// a tombstone with the deletion time and original path recorded in its metadata. Versions are
+// appended if a tombstone already exists in that path. Returns the tombstone version with the
+// current data of cur.
+func (v *Vault) archiveSecret(cur *secret.Secret) (int, error) {
+	tombstone := secret.New(v.TombstonePrefix + cur.Name)
+	tombstone.SourceID = cur.SourceID
+	tombstone.AddTags(cur.Tags)
+	for key, val := range cur.Meta {
+		tombstone.Meta[key] = val
+	}
+	tombstone.Meta[secret.MetaDeletedAt] = time.Now().UTC().Format(time.RFC3339)
+	tombstone.Meta[secret.MetaOriginalPath] = cur.Name
+
+	current, _ := strconv.Atoi(cur.Version)
+	versions := v.getSecretHistory(v.Context, cur.Name, current, secret.HistoryAll)
+	versions = append(versions, &secret.Version{ID: cur.Version, Data: cur.Data})
+
+	cas := v.getCurrentVersion(tombstone.Name)
+	casBefore := cas
+	for _, version := range versions {
+		written, err := v.putSecretData(tombstone.Name, version.Data, cas, cur.Name)
+		if err != nil {
+			return 0, err
+		}
+		cas = written
+	}
+
+	if err := v.putSecretMetadata(tombstone, casBefore == 0); err != nil {
+		return 0, err
+	}
+
+	log.WithFields(log.Fields{
+		"path":      cur.Name,
+		"system":    "HashiCorp Vault",
+		"tombstone": tombstone.Name,
+		"versions":  len(versions),
+	}).Info("Archived removed secret with its history")
+
+	return cas, nil
+}
+
+// getCurrentVersion returns the current version of the secret in path, or 0 if it does not exist.
+func (v *Vault) getCurrentVersion(path string) int {
+	metadata, err := v.Client.KVv2(v.Engine).GetMetadata(v.Context, path)
+	if err != nil {
+		return 0
+	}
+
+	return metadata.CurrentVersion
+}
+
+// getSecret returns data and metadata for secret in path, or nil if the secret does not exist or
+// its current version is deleted. Returns an error if the secret cannot be read. With history other
+// than secret.HistoryLatest, also up to history-1 (or all, if secret.HistoryAll) previous live
+// versions are read into secret's History.
+func (v *Vault) getSecret(path string, history int) (*secret.Secret, error) {
+	s := secret.New(path)
+	fields := log.Fields{
+		"path":   path,
+		"system": "HashiCorp Vault",
+	}
+
+	ctx, span := tracing.StartBackend(v.Context, "secret.get", "vault", path)
+	vs, err := v.Client.KVv2(v.Engine).Get(ctx, s.Name)
+	if errors.Is(err, vault.ErrSecretNotFound) {
+		log.WithFields(fields).Debug("Secret does not exist")
+		tracing.EndWith(span, tracing.OutcomeNotFound)
+		return nil, nil
+	} else if err != nil {
+		log.WithFields(fields).WithError(err).Error("Unable to read secret data")
+		tracing.End(span, err)
+		return nil, err
+	}
+
+	if vs.Data == nil {
+		log.WithFields(fields).Debug("Ignoring deleted secret")
+		tracing.EndWith(span, tracing.OutcomeNotFound)
+		return nil, nil
+	}
+
+	s.AddData(vs.Data)
+	s.AddCustomMetadata(vs.CustomMetadata)
+	s.Version = strconv.Itoa(vs.VersionMetadata.Version)
+
+	// Secrets synced from another system keep their original ID, others are identified by path
+	if id, ok := s.Meta[secret.MetaSourceID]; ok && id != "" {
+		s.SourceID = id
+	} else {
+		s.SourceID = v.pathID(path)
+	}
+
+	if history != secret.HistoryLatest {
+		s.History = v.getSecretHistory(ctx, path, vs.VersionMetadata.Version, history)
+	}
+	tracing.End(span, nil)
+
+	return s, nil
+}
+
+// getSecretHistory returns live (not deleted nor destroyed) versions of the secret in path older
+// than current, oldest first. Only the newest history-1 versions are returned, unless history is
+// secret.HistoryAll.
+func (v *Vault) getSecretHistory(ctx context.Context, path string, current, history int) []*secret.Version {
+	var versions []*secret.Version
+	fields := log.Fields{
+		"path":   path,
+		"system": "HashiCorp Vault",
+	}
+
+	metadata, err := v.Client.KVv2(v.Engine).GetVersionsAsList(ctx, path)
+	if err != nil {
+		log.WithFields(fields).WithError(err).Error("Unable to read secret versions")
+		return nil
+	}
+
+	for _, m := range metadata {
+		if m.Version >= current || m.Destroyed || !m.DeletionTime.IsZero() {
+			continue
+		}
+
+		vs, err := v.Client.KVv2(v.Engine).GetVersion(ctx, path, m.Version)
+		if err != nil || vs.Data == nil {
+			log.WithFields(fields).WithError(err).Warnf("Unable to read secret version %d", m.Version)
+			continue
+		}
+
+		redact.Register(vs.Data)
+		versions = append(versions, &secret.Version{ID: strconv.Itoa(m.Version), Data: vs.Data})
+	}
+
+	if history != secret.HistoryAll && len(versions) > history-1 {
+		versions = versions[len(versions)-(history-1):]
+	}
+
+	return versions
+}
+
+// getSecretKeys returns a list of secret keys under given path. Exits if they cannot be listed.
+func (v *Vault) getSecretKeys(ctx context.Context, path string) []string {
 	fullPath := v.Engine + "/metadata/" + path
 
 	log.WithFields(log.Fields{
@@ -276,7 +980,7 @@ func (v *Vault) getSecretKeys(path string) []string {
 		"system": "HashiCorp Vault",
 	}).Debug("Retrieving secret keys")
 
-	s, err := v.Client.Logical().List(fullPath)
+	keys, err := v.listSecretKeys(ctx, path)
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"path":   fullPath,
@@ -284,26 +988,46 @@ func (v *Vault) getSecretKeys(path string) []string {
 		}).Fatal("Unable to list secret keys")
 	}
 
-	if s == nil {
+	if len(keys) == 0 {
 		log.WithFields(log.Fields{
 			"path":   fullPath,
 			"system": "HashiCorp Vault",
 		}).Warn("No secrets found")
-		return keys
+	}
+
+	return keys
+}
+
+// listSecretKeys returns a list of secret keys under given path, or an error if they cannot be
+// listed. Internal paths are skipped, unless under path.
+func (v *Vault) listSecretKeys(ctx context.Context, path string) ([]string, error) {
+	var keys []string
+
+	s, err := v.Client.Logical().ListWithContext(ctx, v.Engine+"/metadata/"+path)
+	if err != nil || s == nil {
+		return keys, err
 	}
 
 	for _, data := range s.Data {
 		keysInPath := helper.TransformToArray(data)
 		for _, key := range keysInPath {
+			if path+key == InternalPrefix || path+key == v.TombstonePrefix {
+				continue
+			}
+
 			if strings.HasSuffix(key, "/") {
-				keys = append(keys, v.getSecretKeys(path+key)...)
+				nested, err := v.listSecretKeys(ctx, path+key)
+				if err != nil {
+					return keys, err
+				}
+				keys = append(keys, nested...)
 			} else {
 				keys = append(keys, path+key)
 			}
 		}
 	}
 
-	return keys
+	return keys, nil
 }
 
 // hasEngine returns a boolean indicating whether a Secrets Engine with name already exists.
@@ -325,37 +1049,333 @@ func (v *Vault) hasEngine(name string) bool {
 	return false
 }
 
-// putSecretData overwrites existing secret data or, if secret does not exist, creates new secret
-// with data from secret.Data and empty metadata.
-func (v *Vault) putSecretData(secret *secret.Secret) {
-	_, err := v.Client.KVv2(v.Engine).Put(context.Background(), secret.Name, secret.Data)
+// putSecretData writes data as a new version of the secret in path or, if secret does not exist,
+// creates new secret with data and empty metadata. The write is done with check-and-set: cas must
+// be the current version of the secret, or 0 if the secret should not exist. Returns the version
+// written, or errConflict if cas did not match. The write is recorded in the audit log, with source
+// as the reference to the source of data.
+func (v *Vault) putSecretData(path string, data map[string]interface{}, cas int, source string) (int, error) {
+	fields := log.Fields{
+		"path":   path,
+		"system": "HashiCorp Vault",
+	}
+
+	ctx, span := tracing.StartBackend(v.Context, "secret.put-data", "vault", path)
+	vs, err := v.Client.KVv2(v.Engine).Put(ctx, path, data, vault.WithCheckAndSet(cas))
+	if isCASError(err) {
+		tracing.EndWith(span, tracing.OutcomeConflict)
+		return 0, errConflict
+	}
+	tracing.End(span, err)
+
 	if err != nil {
-		log.WithFields(log.Fields{
-			"path":   secret.Name,
-			"system": "HashiCorp Vault",
-		}).WithError(err).Error("Unable to update secret data")
+		log.WithFields(fields).WithError(err).Error("Unable to update secret data")
+		return 0, err
 	}
 
-	log.WithFields(log.Fields{
+	log.WithFields(fields).Info("Succesfully put data to Vault secret")
+
+	event := &audit.Event{
+		Event:        audit.EventDataWritten,
+		Path:         path,
+		Source:       source,
+		VersionAfter: strconv.Itoa(vs.VersionMetadata.Version),
+		Hash:         v.hash(data),
+	}
+	if cas > 0 {
+		event.VersionBefore = strconv.Itoa(cas)
+	}
+	v.recordAudit(event)
+
+	return vs.VersionMetadata.Version, nil
+}
+
+// putSecretMetadata overwrites existing secret metadata or, if secret does not exist, creates new
+// secret with metadata from secret.Tags and secret.Meta, and empty data. Check-and-set is required
+// for secrets created if v.CASRequired is set. Settings of existing secrets, such as whether
+// check-and-set is required, are kept as they are.
+func (v *Vault) putSecretMetadata(secret *secret.Secret, create bool) error {
+	fields := log.Fields{
 		"path":   secret.Name,
 		"system": "HashiCorp Vault",
-	}).Info("Succesfully put data to Vault secret")
-}
+	}
+
+	metadata := vault.KVMetadataPutInput{
+		CASRequired:    create && v.CASRequired,
+		CustomMetadata: secret.CustomMetadata(),
+	}
 
-// putSecretMetaadta overwrites existing secret metadadata or, if secret does not exist, creates
-// new secret with metadata from secret.Tags and empty data.
-func (v *Vault) putSecretMetadata(secret *secret.Secret) {
-	metadata := vault.KVMetadataPutInput{CustomMetadata: secret.Tags}
-	err := v.Client.KVv2(v.Engine).PutMetadata(context.Background(), secret.Name, metadata)
+	ctx, span := tracing.StartBackend(v.Context, "secret.put-metadata", "vault", secret.Name)
+
+	if !create {
+		if cur, err := v.Client.KVv2(v.Engine).GetMetadata(ctx, secret.Name); err == nil {
+			metadata.CASRequired = cur.CASRequired
+			metadata.DeleteVersionAfter = cur.DeleteVersionAfter
+			metadata.MaxVersions = cur.MaxVersions
+		}
+	}
+
+	err := v.Client.KVv2(v.Engine).PutMetadata(ctx, secret.Name, metadata)
+	tracing.End(span, err)
 	if err != nil {
+		log.WithFields(fields).WithError(err).Error("Unable to update secret metadata")
+		return err
+	}
+
+	log.WithFields(fields).Info("Succesfully put metadata to Vault secret")
+
+	v.recordAudit(&audit.Event{
+		Event:  audit.EventMetadataWritten,
+		Path:   secret.Name,
+		Source: audit.SourceRef(secret.SourceID, secret.Version),
+		Hash:   v.hash(metadata.CustomMetadata),
+	})
+
+	return nil
+}
+
+// recordAudit appends e to the audit log, with the system and the token identity of v.
+func (v *Vault) recordAudit(e *audit.Event) {
+	e.System = "HashiCorp Vault"
+	e.Identity = v.tokenIdentity()
+
+	if err := audit.Record(e); err != nil {
 		log.WithFields(log.Fields{
-			"path":   secret.Name,
+			"path":   e.Path,
 			"system": "HashiCorp Vault",
-		}).WithError(err).Error("Unable to update secret metadata")
+		}).WithError(err).Error("Unable to write audit log")
+	}
+}
+
+// tokenIdentity returns the display name and accessor of the token v is authenticated with, such
+// as "kubernetes-sync/secret-sync (accessor hmzH...)". It is looked up once, and falls back to
+// v.Identity if the token cannot look itself up.
+func (v *Vault) tokenIdentity() string {
+	if v.actor != "" {
+		return v.actor
+	}
+
+	v.actor = v.Identity()
+
+	token, err := v.Client.Auth().Token().LookupSelfWithContext(v.Context)
+	if err != nil || token == nil {
+		log.WithFields(log.Fields{
+			"system": "HashiCorp Vault",
+		}).WithError(err).Warn("Unable to look up token, auditing changes with Vault address")
+		return v.actor
+	}
+
+	name, _ := token.Data["display_name"].(string)
+	accessor, _ := token.Data["accessor"].(string)
+	switch {
+	case name != "" && accessor != "":
+		v.actor = fmt.Sprintf("%s (accessor %s)", name, accessor)
+	case name != "":
+		v.actor = name
+	case accessor != "":
+		v.actor = "accessor " + accessor
+	}
+
+	return v.actor
+}
+
+// pathID returns the source ID of the secret in path which was not synced from another system.
+func (v *Vault) pathID(path string) string {
+	return v.Address + "/" + v.Engine + "/" + path
+}
+
+// readSecrets returns a Slice with all secrets from Vault which belong to env and match v.Filter,
+// including up to history versions of each.
+func (v *Vault) readSecrets(env *secret.Environment, history int) []*secret.Secret {
+	if env == nil {
+		env = &secret.GlobalEnv
+	}
+
+	var read, secrets []*secret.Secret
+
+	ctx, span := tracing.StartBackend(v.Context, "secrets.list", "vault", "")
+	keys := v.getSecretKeys(ctx, "")
+	tracing.End(span, nil)
+
+	v.redirects = nil
+	for _, key := range keys {
+		s, err := v.getSecret(key, history)
+		switch {
+		case err != nil:
+			// A secret which cannot be read is failed, so that it's left untouched wherever it's
+			// synced to, rather than taken as removed
+			s = secret.New(key)
+			s.Fail(fmt.Errorf("unable to read secret: %w", err))
+			read = append(read, s)
+		case s != nil:
+			read = append(read, s)
+		default:
+			if r := v.readRedirect(key); r != nil {
+				v.redirects = append(v.redirects, r)
+			}
+		}
+	}
+
+	for _, s := range read {
+		// Secrets moved with a redirect keep the ID of their original path, so that their renames
+		// are detected in the destination
+		if s.Meta[secret.MetaSourceID] == "" {
+			s.SourceID = v.pathID(v.originPath(s.Name))
+		}
+		s.SetEnv()
+
+		// Tags of a failed secret are unknown, so it's kept in any environment and matched by path
+		filter := v.Filter
+		if s.Err != nil {
+			filter = filter.PathsOnly()
+			if s.Environment == nil {
+				s.Environment = env
+			}
+		}
+
+		if s.BelongsToEnv(env) {
+			if !env.IsGroup {
+				s.TrimNameEnv()
+			}
+			if filter.Matches(s) {
+				secrets = append(secrets, s)
+			}
+		}
 	}
 
 	log.WithFields(log.Fields{
-		"path":   secret.Name,
+		"count":  len(secrets),
+		"system": "HashiCorp Vault",
+	}).Info("Secrets successfully read")
+
+	return secrets
+}
+
+// changed returns a boolean indicating whether a writes anything to Vault.
+func (a *action) changed() bool {
+	return len(a.versions) > 0 || a.metadata
+}
+
+// handleLeak handles cur, a production secret in Vault which new, its source secret, is blocked
+// from. With v.ProductionLeaks set to LeaksDelete, cur is deleted according to v.DeleteStrategy.
+// Otherwise cur is kept, and reported and audited as a leak, so that it can be removed by hand.
+func (v *Vault) handleLeak(new, cur *secret.Secret) {
+	fields := log.Fields{
+		"path":   cur.Name,
 		"system": "HashiCorp Vault",
-	}).Info("Succesfully put metadata to Vault secret")
+	}
+	reason := "leaked " + new.Err.Error()
+
+	if v.ProductionLeaks == LeaksDelete {
+		if err := v.deleteSecret(cur, reason+", "+v.DeleteStrategy); err != nil {
+			report.Record(new.Name, report.ActionFailed, reason, err)
+			return
+		}
+
+		log.WithFields(fields).Warn("Deleted production secret leaked to a non-production environment")
+		report.Record(new.Name, report.ActionDeleted, reason, nil)
+		return
+	}
+
+	log.WithFields(fields).Error("Production secret leaked to a non-production environment, " +
+		"delete it or set " + EnvProductionLeaks + "=" + LeaksDelete)
+	report.Record(new.Name, report.ActionFailed, reason+", kept", new.Err)
+
+	if !v.DryRun {
+		v.recordAudit(&audit.Event{
+			Event:         audit.EventProductionLeaked,
+			Path:          cur.Name,
+			VersionBefore: cur.Version,
+			Reason:        reason,
+		})
+	}
+}
+
+// isCASError returns a boolean indicating whether err is caused by a check-and-set mismatch.
+func isCASError(err error) bool {
+	var respErr *vault.ResponseError
+	if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+
+	for _, e := range respErr.Errors {
+		if strings.Contains(e, "check-and-set") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// planAction returns the action required to update cur to match new, whose content hash is hash.
+// cur is nil if the secret does not exist in Vault.
+func planAction(new, cur *secret.Secret, hash string) *action {
+	cas := 0
+	if cur != nil {
+		cas, _ = strconv.Atoi(cur.Version)
+	}
+
+	return &action{
+		secret:   new,
+		current:  cur,
+		cas:      cas,
+		versions: pendingVersions(new, cur),
+		metadata: cur == nil || !new.EqualTags(cur) ||
+			cur.Meta[secret.MetaSourceID] != new.SourceID ||
+			cur.Meta[secret.MetaSourceVersion] != new.Version ||
+			cur.Meta[secret.MetaPayloadType] != new.Meta[secret.MetaPayloadType] ||
+			cur.Meta[secret.MetaContentHash] != hash,
+	}
+}
+
+// pendingVersions returns the versions of new which have not been written to cur yet, oldest
+// first. The last synced version is identified by the source version recorded in cur's metadata
+// or, if not recorded, by the newest version with data equal to cur's. If cur's data differs from
+// new's current data, the current version is always included.
+func pendingVersions(new, cur *secret.Secret) []*secret.Version {
+	versions := new.Versions()
+	if cur == nil {
+		return versions
+	}
+
+	synced := -1
+	for i, version := range versions {
+		if version.ID != "" && version.ID == cur.Meta[secret.MetaSourceVersion] {
+			synced = i
+			break
+		}
+	}
+
+	if synced < 0 {
+		for i, version := range versions {
+			if helper.DeepEqual(version.Data, cur.Data) {
+				synced = i
+			}
+		}
+	}
+
+	pending := versions[synced+1:]
+	if len(pending) == 0 && !new.EqualData(cur) {
+		pending = versions[len(versions)-1:]
+	}
+
+	return pending
+}
+
+// reportAction records the result of applying a in the sync report.
+func reportAction(a *action, err error) {
+	name := a.secret.Name
+
+	switch {
+	case err != nil:
+		report.Record(name, report.ActionFailed, a.reason, err)
+	case a.current == nil:
+		report.Record(name, report.ActionCreated, a.reason, nil)
+	case len(a.versions) > 0:
+		report.Record(name, report.ActionDataUpdated, a.reason, nil)
+	case a.metadata:
+		report.Record(name, report.ActionTagsUpdated, a.reason, nil)
+	default:
+		report.Record(name, report.ActionUnchanged, a.reason, nil)
+	}
 }
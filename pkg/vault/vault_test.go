@@ -0,0 +1,249 @@
+package vault
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync-secrets/pkg/helper"
+	"sync-secrets/pkg/report"
+	"sync-secrets/pkg/secret"
+	"testing"
+)
+
+// source returns a source secret with a version per data, oldest first, with IDs v1, v2 and so on.
+func source(data ...interface{}) *secret.Secret {
+	s := secret.New("apps/db")
+	for i, d := range data {
+		version := &secret.Version{ID: "v" + strconv.Itoa(i+1), Data: map[string]interface{}{"value": d}}
+		if i < len(data)-1 {
+			s.History = append(s.History, version)
+			continue
+		}
+		s.Version, s.Data = version.ID, version.Data
+	}
+
+	return s
+}
+
+// destination returns a destination secret with data and, if not empty, the synced sourceVersion.
+func destination(data interface{}, sourceVersion string) *secret.Secret {
+	s := secret.New("apps/db")
+	s.Data["value"] = data
+	if sourceVersion != "" {
+		s.Meta[secret.MetaSourceVersion] = sourceVersion
+	}
+
+	return s
+}
+
+func TestPendingVersions(t *testing.T) {
+	tests := []struct {
+		name string
+		new  *secret.Secret
+		cur  *secret.Secret
+		want string // IDs of pending versions
+	}{
+		{"new secret", source("a", "b", "c"), nil, "v1,v2,v3"},
+		{"synced", source("a", "b", "c"), destination("c", "v3"), ""},
+		{"newer versions", source("a", "b", "c"), destination("a", "v1"), "v2,v3"},
+		{"synced version changed in destination", source("a", "b"), destination("x", "v2"), "v2"},
+		{"unknown version, equal data", source("a", "b", "c"), destination("b", "v9"), "v3"},
+		{"no version, equal data", source("a", "b", "c"), destination("b", ""), "v3"},
+		{"newest of equal data", source("a", "b", "a", "c"), destination("a", ""), "v4"},
+		{"no version matches", source("a", "b"), destination("x", ""), "v1,v2"},
+		{"numbers written differently", source(json.Number("1.0")), destination(json.Number("1"), ""), "v1"},
+		{"no history", source("a"), destination("a", ""), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ids []string
+			for _, version := range pendingVersions(tt.new, tt.cur) {
+				ids = append(ids, version.ID)
+			}
+			if got := strings.Join(ids, ","); got != tt.want {
+				t.Errorf("pendingVersions() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// actions returns the actions recorded for each secret in job, by name.
+func actions(job *report.Job) map[string]string {
+	actions := make(map[string]string)
+	for _, s := range job.Secrets {
+		actions[s.Name] = s.Action
+	}
+
+	return actions
+}
+
+func TestUpdateSecretsKeepsUnreadableSecrets(t *testing.T) {
+	source := newVaultServer(t)
+	source.put("apps/db-dev", map[string]interface{}{"password": "new"}, nil)
+	source.put("apps/cache", map[string]interface{}{"password": "new"}, map[string]interface{}{"Environment": "dev"})
+	source.put("apps/api-dev", map[string]interface{}{"token": "new"}, nil)
+	source.fail("apps/db-dev")
+	source.fail("apps/cache")
+
+	dest := newVaultServer(t)
+	for _, path := range []string{"apps/db", "apps/cache", "apps/removed"} {
+		dest.put(path, map[string]interface{}{"password": "old"}, map[string]interface{}{"Environment": "dev"})
+	}
+
+	report.StartJob("test", "", secret.DevEnv.Name)
+	secrets := newTestVault(t, source, nil).GetSecrets(&secret.DevEnv)
+	newTestVault(t, dest, nil).UpdateSecrets(secrets)
+	got := actions(report.EndJob())
+
+	for _, path := range []string{"apps/db", "apps/cache"} {
+		if data := dest.data(path); data["password"] != "old" {
+			t.Errorf("data of %s = %v, want it left untouched", path, data)
+		}
+		if got[path] != report.ActionFailed {
+			t.Errorf("action of %s = %q, want %q", path, got[path], report.ActionFailed)
+		}
+	}
+
+	if data := dest.data("apps/removed"); data != nil {
+		t.Errorf("data of apps/removed = %v, want it deleted", data)
+	}
+	if data := dest.data("apps/api"); data["token"] != "new" {
+		t.Errorf("data of apps/api = %v, want it created", data)
+	}
+}
+
+func TestUpdateSecretsDriftPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		data   string // Password in Vault after the sync
+		action string
+		reason string
+		err    bool
+	}{
+		{DriftOverwrite, "new", report.ActionDataUpdated, "drifted, overwritten", false},
+		{DriftSkip, "changed", report.ActionSkipped, "drifted", false},
+		{DriftFail, "changed", report.ActionFailed, "drifted, sync refused", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			source := newVaultServer(t)
+			source.put("apps/db-dev", map[string]interface{}{"password": "new"}, nil)
+
+			dest := newVaultServer(t)
+			dest.put("apps/db", map[string]interface{}{"password": "changed"}, map[string]interface{}{
+				"Environment":          "dev",
+				secret.MetaContentHash: helper.HMACPrefix + "0123456789abcdef",
+			})
+
+			report.StartJob("test", "", secret.DevEnv.Name)
+			secrets := newTestVault(t, source, nil).GetSecrets(&secret.DevEnv)
+			err := newTestVault(t, dest, map[string]string{EnvDriftPolicy: tt.policy}).UpdateSecrets(secrets)
+			job := report.EndJob()
+
+			if (err != nil) != tt.err {
+				t.Errorf("UpdateSecrets() error = %v, want error %v", err, tt.err)
+			}
+			if data := dest.data("apps/db"); data["password"] != tt.data {
+				t.Errorf("data of apps/db = %v, want password %q", data, tt.data)
+			}
+			if len(job.Secrets) != 1 || job.Secrets[0].Action != tt.action || job.Secrets[0].Reason != tt.reason {
+				t.Errorf("report = %+v, want %s with reason %q", job.Secrets, tt.action, tt.reason)
+			}
+		})
+	}
+}
+
+func TestUpdateSecretsConflicts(t *testing.T) {
+	tests := []struct {
+		name       string
+		concurrent int  // Writes preceded by a concurrent write
+		metadata   bool // Whether writes of metadata fail
+		action     string
+		reason     string
+	}{
+		{"written", 0, false, report.ActionDataUpdated, ""},
+		{"written again", 1, false, report.ActionDataUpdated, "conflict, attempt 2 of 3"},
+		{"given up", maxCASAttempts, false, report.ActionFailed, "conflict, attempt 3 of 3"},
+		{"metadata failed", 0, true, report.ActionFailed, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := newVaultServer(t)
+			source.put("apps/db-dev", map[string]interface{}{"password": "new"}, nil)
+
+			dest := newVaultServer(t)
+			dest.put("apps/db", map[string]interface{}{"password": "old"}, map[string]interface{}{"Environment": "dev"})
+			dest.writeConcurrently("apps/db", tt.concurrent)
+			if tt.metadata {
+				dest.failMetadata("apps/db")
+			}
+
+			report.StartJob("test", "", secret.DevEnv.Name)
+			secrets := newTestVault(t, source, nil).GetSecrets(&secret.DevEnv)
+			newTestVault(t, dest, nil).UpdateSecrets(secrets)
+			job := report.EndJob()
+
+			if len(job.Secrets) != 1 || job.Secrets[0].Action != tt.action || job.Secrets[0].Reason != tt.reason {
+				t.Errorf("report = %+v, want %s with reason %q", job.Secrets, tt.action, tt.reason)
+			}
+		})
+	}
+}
+
+func TestRollbackDestroyedSecret(t *testing.T) {
+	source := newVaultServer(t)
+	source.put("apps/db-dev", map[string]interface{}{"password": "new"}, nil)
+
+	dest := newVaultServer(t)
+	for _, path := range []string{"apps/db", "apps/removed"} {
+		dest.put(path, map[string]interface{}{"password": "old"}, map[string]interface{}{"Environment": "dev"})
+	}
+
+	secrets := newTestVault(t, source, nil).GetSecrets(&secret.DevEnv)
+	v := newTestVault(t, dest, nil)
+	v.SyncID = "20231018T102030Z-1a2b3c4d"
+	v.UpdateSecrets(secrets)
+
+	if v.DeleteStrategy != DeleteDestroy {
+		t.Fatalf("DeleteStrategy = %q, want default %q", v.DeleteStrategy, DeleteDestroy)
+	}
+	if data := dest.data("apps/removed"); data != nil {
+		t.Fatalf("data of apps/removed = %v, want it destroyed", data)
+	}
+
+	if err := newTestVault(t, dest, nil).Rollback(v.SyncID); err != nil {
+		t.Fatalf("Rollback() error = %v", err)
+	}
+
+	for _, path := range []string{"apps/db", "apps/removed"} {
+		if data := dest.data(path); data["password"] != "old" {
+			t.Errorf("data of %s = %v, want it rolled back", path, data)
+		}
+	}
+}
+
+func TestPruneSyncRecords(t *testing.T) {
+	source := newVaultServer(t)
+	dest := newVaultServer(t)
+	for _, syncID := range []string{"20231018T102030Z-1a2b3c4d", "20231019T102030Z-5e6f7a8b"} {
+		dest.put("apps/removed", map[string]interface{}{"password": syncID}, map[string]interface{}{"Environment": "dev"})
+
+		v := newTestVault(t, dest, map[string]string{EnvSyncRecords: "1"})
+		v.SyncID = syncID
+		v.UpdateSecrets(newTestVault(t, source, nil).GetSecrets(&secret.DevEnv))
+	}
+
+	for path, want := range map[string]bool{
+		syncRecordPath + "20231018T102030Z-1a2b3c4d":            false,
+		keptDataPath + "20231018T102030Z-1a2b3c4d/apps/removed": false,
+		syncRecordPath + "20231019T102030Z-5e6f7a8b":            true,
+		keptDataPath + "20231019T102030Z-5e6f7a8b/apps/removed": true,
+	} {
+		if got := dest.data(path) != nil; got != want {
+			t.Errorf("%s exists = %v, want %v", path, got, want)
+		}
+	}
+}